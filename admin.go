@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// adminServer serves HTTP API to inspect and manage volumes staged on the node:
+//
+//	GET  /volumes                  - list volumes with their status
+//	GET  /volumes/{id}             - status of the volume
+//	POST /volumes/{id}/freeze      - stop applying new data to the volume
+//	POST /volumes/{id}/unfreeze    - resume applying new data to the volume
+//	GET  /volumes/{id}/generations - generations of the volume content kept on the node
+//	POST /volumes/{id}/rollback    - switch the volume to the previous or ?generation=N generation and freeze it
+//	PUT  /volumes/{id}/credentials - replace credentials of the volume with JSON object of node-stage secret keys
+//	GET  /metrics                  - metrics in Prometheus text format
+type adminServer struct {
+	ns       *nodeServer
+	endpoint string
+	server   *http.Server
+}
+
+func newAdminServer(ns *nodeServer, endpoint string) *adminServer {
+	as := &adminServer{ns: ns, endpoint: endpoint}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/volumes", as.handleVolumes)
+	mux.HandleFunc("/volumes/", as.handleVolume)
+	mux.HandleFunc("/metrics", as.handleMetrics)
+	as.server = &http.Server{Handler: mux}
+	return as
+}
+
+// adminSocketPath returns the path of the admin API socket.
+// The API has no authentication and can replace credentials of volumes, so it is served on a unix socket only.
+func adminSocketPath(endpoint string) (string, error) {
+	uri, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse admin endpoint: %w", err)
+	}
+	if uri.Scheme != "unix" || uri.Path == "" {
+		return "", fmt.Errorf("admin endpoint must be a unix socket, e.g. unix:///csi/admin.sock: %q", endpoint)
+	}
+	return uri.Path, nil
+}
+
+// listenAdmin creates the admin API socket accessible by its owner (root) only.
+// The socket is created under a temporary name and renamed after chmod, so others can't connect to it in between.
+func listenAdmin(endpoint string) (net.Listener, error) {
+	path, err := adminSocketPath(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove socket %s: %w", tmp, err)
+	}
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (as *adminServer) run() {
+	listener, err := listenAdmin(as.endpoint)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to listen admin endpoint")
+	}
+	if err := as.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Fatal().Err(err).Msg("failed to serve admin endpoint")
+	}
+}
+
+func (as *adminServer) stop() {
+	as.server.Close()
+}
+
+func (as *adminServer) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, as.ns.volumeInfos())
+}
+
+func (as *adminServer) handleVolume(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/volumes/"), "/")
+	volumeId, err := url.PathUnescape(parts[0])
+	if err != nil || volumeId == "" || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		for _, info := range as.ns.volumeInfos() {
+			if info.VolumeID == volumeId {
+				writeJSON(w, info)
+				return
+			}
+		}
+		http.Error(w, errVolumeNotFound.Error(), http.StatusNotFound)
+	case (action == "freeze" || action == "unfreeze") && r.Method == http.MethodPost:
+		as.handleError(w, as.ns.freezeVolume(volumeId, action == "freeze"))
+	case action == "generations" && r.Method == http.MethodGet:
+		gens, err := as.ns.volumeGenerations(volumeId)
+		if err != nil {
+			as.handleError(w, err)
+			return
+		}
+		writeJSON(w, gens)
+	case action == "rollback" && r.Method == http.MethodPost:
+		gen := 0
+		if genStr := r.URL.Query().Get("generation"); genStr != "" {
+			if gen, err = strconv.Atoi(genStr); err != nil || gen <= 0 {
+				http.Error(w, fmt.Sprintf("invalid generation: %q", genStr), http.StatusBadRequest)
+				return
+			}
+		}
+		gen, err := as.ns.rollbackVolume(volumeId, gen)
+		if err != nil {
+			as.handleError(w, err)
+			return
+		}
+		writeJSON(w, struct {
+			Generation int `json:"generation"`
+		}{gen})
+	case action == "credentials" && r.Method == http.MethodPut:
+		var secrets map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&secrets); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		for key := range secrets {
+			if !isCredentialKey(key) {
+				http.Error(w, fmt.Sprintf("unknown credential key: %q", key), http.StatusBadRequest)
+				return
+			}
+		}
+		_, err := as.ns.setCredentials(volumeId, readCredentials(secrets))
+		as.handleError(w, err)
+	case action == "" || action == "freeze" || action == "unfreeze" || action == "generations" || action == "rollback" || action == "credentials":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (as *adminServer) handleError(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errVolumeNotFound, errGenerationNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errVolumeBusy:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		if errors.Is(err, errInvalidCredentials) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (as *adminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	infos := as.ns.volumeInfos()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, help string, value func(info volumeInfo) (float64, bool)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, info := range infos {
+			if v, ok := value(info); ok {
+				fmt.Fprintf(w, "%s{volume_id=\"%s\"} %g\n", name, escapeLabelValue(info.VolumeID), v)
+			}
+		}
+	}
+	metric("onlineconf_csi_volume_frozen", "Whether applying new data to the volume is frozen.", func(info volumeInfo) (float64, bool) {
+		if info.Frozen {
+			return 1, true
+		}
+		return 0, true
+	})
+	metric("onlineconf_csi_volume_generation", "Current generation of the volume content.", func(info volumeInfo) (float64, bool) {
+		return float64(info.Generation), true
+	})
+	metric("onlineconf_csi_volume_last_success_timestamp_seconds", "Time of the last successful request to onlineconf-admin.", func(info volumeInfo) (float64, bool) {
+		if info.LastSuccess == nil {
+			return 0, false
+		}
+		return float64(info.LastSuccess.UnixNano()) / 1e9, true
+	})
+	metric("onlineconf_csi_volume_last_attempt_timestamp_seconds", "Time of the last request to onlineconf-admin.", func(info volumeInfo) (float64, bool) {
+		if info.LastAttempt == nil {
+			return 0, false
+		}
+		return float64(info.LastAttempt.UnixNano()) / 1e9, true
+	})
+	metric("onlineconf_csi_volume_last_attempt_failed", "Whether the last request to onlineconf-admin has failed.", func(info volumeInfo) (float64, bool) {
+		if info.LastError != "" {
+			return 1, true
+		}
+		return 0, true
+	})
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Error().Err(err).Msg("failed to write response")
+	}
+}
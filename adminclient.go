@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const adminUsage = `usage: onlineconf-csi-driver -admin ENDPOINT COMMAND [ARGS]
+
+commands:
+  volumes                        list volumes with their status
+  status VOLUME_ID               show status of the volume
+  generations VOLUME_ID          list generations of the volume content kept on the node
+  freeze VOLUME_ID               stop applying new data to the volume
+  unfreeze VOLUME_ID             resume applying new data to the volume
+  rollback VOLUME_ID [GEN]       switch the volume to the previous or given generation and freeze it
+`
+
+var errAdminUsage = errors.New("invalid command")
+
+// runAdminCommand performs the command against the admin API of a running node server and writes the response to out.
+func runAdminCommand(endpoint string, args []string, out io.Writer) error {
+	if endpoint == "" || len(args) == 0 {
+		return errAdminUsage
+	}
+	socket, err := adminSocketPath(endpoint)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	base := "http://localhost"
+
+	method := http.MethodGet
+	var path string
+	switch cmd := args[0]; {
+	case cmd == "volumes" && len(args) == 1:
+		path = "/volumes"
+	case cmd == "status" && len(args) == 2:
+		path = "/volumes/" + url.PathEscape(args[1])
+	case cmd == "generations" && len(args) == 2:
+		path = "/volumes/" + url.PathEscape(args[1]) + "/generations"
+	case (cmd == "freeze" || cmd == "unfreeze") && len(args) == 2:
+		method = http.MethodPost
+		path = "/volumes/" + url.PathEscape(args[1]) + "/" + cmd
+	case cmd == "rollback" && (len(args) == 2 || len(args) == 3):
+		method = http.MethodPost
+		path = "/volumes/" + url.PathEscape(args[1]) + "/rollback"
+		if len(args) == 3 {
+			path += "?generation=" + url.QueryEscape(args[2])
+		}
+	default:
+		return errAdminUsage
+	}
+
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	_, err = out.Write(body)
+	return err
+}
+
+func adminCommand(endpoint string, args []string) int {
+	if err := runAdminCommand(endpoint, args, os.Stdout); err == errAdminUsage {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+const endpointAliasesReloadInterval = 10 * time.Second
+
+// endpointAlias is a named onlineconf-admin referenced by endpoint volume attribute instead of uri,
+// so that volumes don't break when onlineconf-admin is moved.
+// Connection settings of the alias are used unless they are set by the volume (or its secret for caFile).
+type endpointAlias struct {
+	URI            string        `yaml:"uri"`
+	CAFile         string        `yaml:"caFile"`
+	TLSMinVersion  string        `yaml:"tlsMinVersion"`
+	TLSServerName  string        `yaml:"tlsServerName"`
+	HTTPProxy      string        `yaml:"httpProxy"`
+	NoProxy        string        `yaml:"noProxy"`
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	caCert         string        // content of CAFile, so changed certificates are detected on reload
+}
+
+// endpointAliases are aliases loaded from a YAML file shared by the controller and nodes:
+//
+//	endpoints:
+//	  prod:
+//	    uri: https://onlineconf.example.com
+//	    caFile: /etc/onlineconf-csi-driver/ca.crt
+//	  staging:
+//	    uri: http://onlineconf-staging.example.com
+//	    httpProxy: http://proxy.example.com:3128
+//
+// Nodes reload the file periodically and apply changed aliases to staged volumes, the controller reloads it on every call.
+type endpointAliases struct {
+	file    string
+	m       sync.RWMutex
+	aliases map[string]endpointAlias
+}
+
+func loadEndpointAliases(file string) (*endpointAliases, error) {
+	ea := &endpointAliases{file: file}
+	if _, err := ea.reload(); err != nil {
+		return nil, err
+	}
+	return ea, nil
+}
+
+// reload reads the file again and returns sorted names of added, changed and removed aliases.
+// The previous aliases are kept if the file is invalid.
+func (ea *endpointAliases) reload() ([]string, error) {
+	content, err := ioutil.ReadFile(ea.file)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Endpoints map[string]endpointAlias `yaml:"endpoints"`
+	}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint aliases file %s: %w", ea.file, err)
+	}
+	for name, alias := range config.Endpoints {
+		if err := alias.load(); err != nil {
+			return nil, fmt.Errorf("invalid endpoint alias %q: %w", name, err)
+		}
+		config.Endpoints[name] = alias
+	}
+
+	ea.m.Lock()
+	defer ea.m.Unlock()
+	var changed []string
+	for name, alias := range config.Endpoints {
+		if prev, ok := ea.aliases[name]; !ok || prev != alias {
+			changed = append(changed, name)
+		}
+	}
+	for name := range ea.aliases {
+		if _, ok := config.Endpoints[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	ea.aliases = config.Endpoints
+	return changed, nil
+}
+
+// load validates the alias and reads its CA certificate.
+func (alias *endpointAlias) load() error {
+	if u, err := url.Parse(alias.URI); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("uri must be an absolute http or https URL: %q", alias.URI)
+	}
+	if _, ok := tlsVersions[alias.TLSMinVersion]; !ok && alias.TLSMinVersion != "" {
+		return fmt.Errorf("tlsMinVersion invalid value: %q", alias.TLSMinVersion)
+	}
+	if alias.HTTPProxy != "" {
+		if err := validateProxyURL(alias.HTTPProxy); err != nil {
+			return fmt.Errorf("httpProxy invalid value: %w", err)
+		}
+	}
+	if alias.RequestTimeout < 0 || alias.ConnectTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if alias.CAFile != "" {
+		content, err := ioutil.ReadFile(alias.CAFile)
+		if err != nil {
+			return err
+		}
+		alias.caCert = string(content)
+		if _, err := (transportSettings{caCert: alias.caCert}).tlsConfig(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get returns the alias, it is safe to call on nil.
+func (ea *endpointAliases) get(name string) (endpointAlias, bool) {
+	if ea == nil {
+		return endpointAlias{}, false
+	}
+	ea.m.RLock()
+	defer ea.m.RUnlock()
+	alias, ok := ea.aliases[name]
+	return alias, ok
+}
+
+// resolve returns the state with URI and connection settings of its endpoint alias.
+// The state is returned unchanged if it doesn't use an alias or the alias is unknown.
+func (ea *endpointAliases) resolve(state updaterState) updaterState {
+	if state.Endpoint == "" {
+		return state
+	}
+	alias, ok := ea.get(state.Endpoint)
+	if !ok {
+		return state
+	}
+	state.URI = alias.URI
+	if state.CACert == "" {
+		state.CACert = alias.caCert
+	}
+	if state.TLSMinVersion == "" {
+		state.TLSMinVersion = alias.TLSMinVersion
+	}
+	if state.TLSServerName == "" {
+		state.TLSServerName = alias.TLSServerName
+	}
+	if state.HTTPProxy == "" {
+		state.HTTPProxy = alias.HTTPProxy
+	}
+	if state.NoProxy == "" {
+		state.NoProxy = alias.NoProxy
+	}
+	if state.RequestTimeout == 0 {
+		state.RequestTimeout = alias.RequestTimeout
+	}
+	if state.ConnectTimeout == 0 {
+		state.ConnectTimeout = alias.ConnectTimeout
+	}
+	return state
+}
+
+// currentEndpoints rereads endpoint aliases on every call of the controller, which is rare enough to not need a watcher,
+// so a changed file is used without restarting the controller. The previous aliases are used if the file is invalid.
+func (cs *controllerServer) currentEndpoints() *endpointAliases {
+	if cs.endpoints == nil {
+		return nil
+	}
+	if changed, err := cs.endpoints.reload(); err != nil {
+		log.Error().Err(err).Msg("failed to reload endpoint aliases, the previous ones are used")
+	} else if len(changed) > 0 {
+		log.Info().Strs("endpoints", changed).Msg("endpoint aliases changed")
+	}
+	return cs.endpoints
+}
+
+// watchEndpointAliases periodically reloads endpoint aliases and applies changed ones to routes of staged volumes.
+func (ns *nodeServer) watchEndpointAliases() {
+	defer ns.wg.Done()
+	ticker := time.NewTicker(endpointAliasesReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ns.done:
+			return
+		case <-ticker.C:
+		}
+		ns.reloadEndpointAliases()
+	}
+}
+
+func (ns *nodeServer) reloadEndpointAliases() {
+	changed, err := ns.config.endpoints.reload()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reload endpoint aliases, the previous ones are used")
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+	log.Info().Strs("endpoints", changed).Msg("endpoint aliases changed")
+
+	ns.m.Lock()
+	defer ns.m.Unlock()
+	for volumeId, us := range ns.state.Updaters {
+		i := sort.SearchStrings(changed, us.Endpoint)
+		if us.Endpoint == "" || i == len(changed) || changed[i] != us.Endpoint {
+			continue
+		}
+		if _, ok := ns.config.endpoints.get(us.Endpoint); !ok {
+			log.Error().Str("volume_id", volumeId).Str("endpoint", us.Endpoint).Msg("endpoint alias of the volume is removed, the previous settings are used")
+			continue
+		}
+		if ui := ns.updaters[us.DataDir]; ui != nil {
+			if err := ns.router.update(ui.routeURI, ns.config.withDefaults(us)); err != nil {
+				log.Error().Err(err).Str("volume_id", volumeId).Msg("failed to apply endpoint alias")
+				continue
+			}
+			ui.m.Lock()
+			ui.status.URI = stripCredentials(ns.config.endpoints.resolve(us).URI)
+			ui.m.Unlock()
+			log.Info().Str("volume_id", volumeId).Str("endpoint", us.Endpoint).Msg("endpoint alias applied")
+		}
+	}
+}
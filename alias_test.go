@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEndpointAliases(t *testing.T) {
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	ns, dir := testNodeServer(t)
+	defer os.RemoveAll(dir)
+	defer ns.stop()
+	file := filepath.Join(dir, "endpoints.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("endpoints:\n  prod:\n    uri: " + admin.URL + "/prod\n    requestTimeout: 5s\n")
+	endpoints, err := loadEndpointAliases(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.config.endpoints = endpoints
+	stage := func(volumeId string, volCtx map[string]string) error {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeId,
+			StagingTargetPath: filepath.Join(dir, volumeId),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			},
+			VolumeContext: volCtx,
+		})
+		return err
+	}
+
+	if err := stage("vol-1", map[string]string{"endpoint": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if admin.count("/prod") != 1 {
+		t.Errorf("volume is not updated from the endpoint alias")
+	}
+	if us := ns.state.Updaters["vol-1"]; us.Endpoint != "prod" || us.URI != "" {
+		t.Errorf("resolved endpoint alias is persisted: %+v", us)
+	}
+	ui := ns.updaters[filepath.Join(dir, "vol-1")]
+	if route := ns.router.route(ui.routeURI); route.timeout.Seconds() != 5 {
+		t.Errorf("settings of the endpoint alias are not applied: %+v", route)
+	}
+	if err := stage("vol-2", map[string]string{"endpoint": "unknown"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unknown endpoint: unexpected error: %v", err)
+	}
+	if err := stage("vol-2", map[string]string{"endpoint": "prod", "uri": admin.URL}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("endpoint with uri: unexpected error: %v", err)
+	}
+
+	write("endpoints:\n  prod:\n    uri: relative\n")
+	ns.reloadEndpointAliases()
+	if alias, _ := endpoints.get("prod"); alias.URI != admin.URL+"/prod" {
+		t.Errorf("invalid endpoint aliases are applied: %+v", alias)
+	}
+
+	write("endpoints:\n  prod:\n    uri: " + admin.URL + "/moved\n")
+	ns.reloadEndpointAliases()
+	ns.scheduler.updateNow(ui) // fails with "config not modified", the content is the same
+	if admin.count("/moved") != 1 || admin.count("/prod") != 1 {
+		t.Errorf("changed endpoint alias is not applied: %v", admin.requests)
+	}
+	if route := ns.router.route(ui.routeURI); route.timeout != 0 {
+		t.Errorf("removed setting of the endpoint alias is not applied: %+v", route)
+	}
+
+	cs := newControllerServer(nil, nil, endpoints)
+	create := func() error {
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: "vol-3",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			}},
+			Parameters: map[string]string{"endpoint": "staging"},
+		})
+		return err
+	}
+	if err := create(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unknown endpoint on the controller: unexpected error: %v", err)
+	}
+	write("endpoints:\n  staging:\n    uri: " + admin.URL + "/staging\n")
+	if err := create(); err != nil {
+		t.Errorf("added endpoint alias is not reloaded by the controller: %v", err)
+	}
+}
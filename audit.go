@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const auditFile = metadataPrefix + "audit.json"
+
+// volumeParams maps module names to parameter paths to value hashes.
+type volumeParams map[string]map[string]string
+
+type paramChange struct {
+	Module  string `json:"module"`
+	Path    string `json:"path"`
+	OldHash string `json:"oldHash,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+}
+
+type auditRecord struct {
+	Time       time.Time     `json:"time"`
+	Generation int           `json:"generation"`
+	Added      []paramChange `json:"added,omitempty"`
+	Removed    []paramChange `json:"removed,omitempty"`
+	Changed    []paramChange `json:"changed,omitempty"`
+}
+
+// readVolumeParams reads parameters of all modules found in the updater output.
+func readVolumeParams(data volumeData) (volumeParams, error) {
+	params := make(volumeParams)
+	for name, content := range data {
+		if filepath.Ext(name) != ".cdb" {
+			continue
+		}
+		moduleParams, err := readModuleParams(content)
+		if err != nil {
+			return nil, err
+		}
+		hashes := make(map[string]string, len(moduleParams))
+		for _, p := range moduleParams {
+			hashes[p.path] = valueHash(p)
+		}
+		params[moduleName(name)] = hashes
+	}
+	return params, nil
+}
+
+func valueHash(p moduleParam) string {
+	h := sha256.New()
+	if p.json {
+		h.Write([]byte{'j'})
+	} else {
+		h.Write([]byte{'s'})
+	}
+	h.Write([]byte(p.value))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// diffParams returns an audit record of changes between old and new parameters or nil if there are no changes.
+func diffParams(old, new volumeParams) *auditRecord {
+	var record auditRecord
+	for module, params := range new {
+		for path, hash := range params {
+			if oldHash, ok := old[module][path]; !ok {
+				record.Added = append(record.Added, paramChange{Module: module, Path: path, Hash: hash})
+			} else if oldHash != hash {
+				record.Changed = append(record.Changed, paramChange{Module: module, Path: path, OldHash: oldHash, Hash: hash})
+			}
+		}
+	}
+	for module, params := range old {
+		for path, hash := range params {
+			if _, ok := new[module][path]; !ok {
+				record.Removed = append(record.Removed, paramChange{Module: module, Path: path, OldHash: hash})
+			}
+		}
+	}
+	if len(record.Added) == 0 && len(record.Removed) == 0 && len(record.Changed) == 0 {
+		return nil
+	}
+	for _, changes := range [][]paramChange{record.Added, record.Removed, record.Changed} {
+		sort.Slice(changes, func(i, j int) bool {
+			if changes[i].Module != changes[j].Module {
+				return changes[i].Module < changes[j].Module
+			}
+			return changes[i].Path < changes[j].Path
+		})
+	}
+	return &record
+}
+
+func logAuditRecord(volumeId string, record *auditRecord) {
+	log.Info().Str("volume_id", volumeId).Int("generation", record.Generation).
+		Interface("added", record.Added).
+		Interface("removed", record.Removed).
+		Interface("changed", record.Changed).
+		Msg("configuration changed")
+}
+
+// appendAuditRecord appends the record to the audit file in dir keeping the last history records.
+func appendAuditRecord(dir string, record *auditRecord, history int, state updaterState) error {
+	path := filepath.Join(dir, auditFile)
+	var records []*auditRecord
+	if content, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(content, &records); err != nil {
+			log.Warn().Err(err).Str("file", path).Msg("failed to parse audit file, truncating")
+			records = nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	records = append(records, record)
+	if len(records) > history {
+		records = records[len(records)-history:]
+	}
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return setPathAttributes(path, state)
+}
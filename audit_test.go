@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffParams(t *testing.T) {
+	oldData := volumeData{
+		"TREE.cdb":  testModuleCDB(t, map[string]string{"/a": "s1", "/b": "s2", "/c": "s3"}),
+		"TREE.conf": []byte("ignored"),
+	}
+	newData := volumeData{
+		"TREE.cdb":  testModuleCDB(t, map[string]string{"/a": "s1", "/b": "j2", "/d": "s4"}),
+		"TREE.conf": []byte("ignored"),
+	}
+	old, err := readVolumeParams(oldData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := readVolumeParams(newData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diffParams(old, old) != nil {
+		t.Error("unexpected diff of equal params")
+	}
+	record := diffParams(old, new)
+	if record == nil {
+		t.Fatal("diff not found")
+	}
+	if len(record.Added) != 1 || record.Added[0].Path != "/d" || record.Added[0].Module != "TREE" {
+		t.Errorf("invalid added: %+v", record.Added)
+	}
+	if len(record.Removed) != 1 || record.Removed[0].Path != "/c" {
+		t.Errorf("invalid removed: %+v", record.Removed)
+	}
+	if len(record.Changed) != 1 || record.Changed[0].Path != "/b" || record.Changed[0].OldHash == record.Changed[0].Hash {
+		t.Errorf("invalid changed: %+v", record.Changed)
+	}
+
+	dir, err := ioutil.TempDir("", "onlineconf-csi-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for gen := 1; gen <= 3; gen++ {
+		record.Generation = gen
+		if err := appendAuditRecord(dir, record, 2, updaterState{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, auditFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []auditRecord
+	if err := json.Unmarshal(content, &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Generation != 2 || records[1].Generation != 3 {
+		t.Errorf("invalid audit file: %s", content)
+	}
+}
@@ -1,23 +1,92 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 var sanityTest bool
 
+// volumeContextValidation configures readVolumeContext, it is set from flags on startup.
+var volumeContextValidation struct {
+	strict bool          // reject unknown and malformed keys
+	policy *volumePolicy // nil if not configured, limits of updateInterval are checked by the policy too
+}
+
+// volumeContextKeys are keys of volume attributes and storage class parameters known to the driver.
+var volumeContextKeys = map[string]bool{
+	"uri":                         true,
+	"endpoint":                    true,
+	"updateInterval":              true,
+	"module":                      true,
+	"path":                        true,
+	"format":                      true,
+	"keepCDB":                     true,
+	"notifyURL":                   true,
+	"auditHistory":                true,
+	"frozen":                      true,
+	"tlsMinVersion":               true,
+	"tlsServerName":               true,
+	"serviceAccountTokenAudience": true,
+	"httpProxy":                   true,
+	"noProxy":                     true,
+	"requestTimeout":              true,
+	"connectTimeout":              true,
+	"snapshot":                    true,
+}
+
+// checkVolumeContextKeys returns an error listing unknown keys and malformed variable keys.
+// Keys with prefixes reserved by Kubernetes are passed by sidecars and kubelet, they are always allowed.
+func checkVolumeContextKeys(parameters map[string]string) error {
+	var unknown, malformed []string
+	for k := range parameters {
+		switch {
+		case volumeContextKeys[k],
+			strings.HasPrefix(k, "csi.storage.k8s.io/"),
+			strings.HasPrefix(k, "storage.kubernetes.io/"):
+		case strings.HasPrefix(k, "${") && strings.HasSuffix(k, "}") && len(k) > 3 && !strings.ContainsAny(k[2:len(k)-1], "${}"):
+		case strings.ContainsAny(k, "${}"):
+			malformed = append(malformed, k)
+		default:
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) == 0 && len(malformed) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	sort.Strings(malformed)
+	var problems []string
+	if len(unknown) > 0 {
+		problems = append(problems, fmt.Sprintf("unknown parameters %q", unknown))
+	}
+	if len(malformed) > 0 {
+		problems = append(problems, fmt.Sprintf("malformed variables %q (must be ${name})", malformed))
+	}
+	return status.Error(codes.InvalidArgument, strings.Join(problems, ", "))
+}
+
 type volumeCapability struct {
-	chmod bool
-	mode  os.FileMode
+	chmod          bool
+	mode           os.FileMode
+	chown          bool
+	uid            int
+	gid            int
+	mountGroup     bool // gid is set by volume_mount_group, the fsGroup of the pod
+	seLinuxContext string
+	mountFlags     uintptr
+	mountOptions   []string
 }
 
 func readVolumeCapability(capability *csi.VolumeCapability) (*volumeCapability, error) {
@@ -39,35 +108,84 @@ func readVolumeCapability(capability *csi.VolumeCapability) (*volumeCapability,
 		return nil, status.Error(codes.InvalidArgument, "unsupported filesystem type")
 	}
 
-	cap := &volumeCapability{}
+	cap := &volumeCapability{uid: -1, gid: -1}
 	for _, flag := range mount.GetMountFlags() {
-		if strings.HasPrefix(flag, "mode=") {
-			val, err := strconv.ParseUint(flag[5:], 8, 12)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to parse mode")
-				return nil, status.Error(codes.InvalidArgument, "invalid mount flags")
-			}
-			cap.chmod = true
-			cap.mode = os.FileMode(val)
+		if err := cap.parseMountFlag(flag); err != nil {
+			return nil, err
 		}
 	}
+	if group := mount.GetVolumeMountGroup(); group != "" {
+		gid, err := strconv.ParseUint(group, 10, 31)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume_mount_group invalid value: %v", err))
+		}
+		if cap.gid != -1 && cap.gid != int(gid) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume_mount_group %d conflicts with mount flag \"gid=%d\"", gid, cap.gid))
+		}
+		cap.chown = true
+		cap.gid = int(gid)
+		cap.mountGroup = true
+	}
 	return cap, nil
 }
 
 type volumeContext struct {
 	uri            string
+	endpoint       string
 	updateInterval time.Duration
+	module         string
+	path           string
+	format         string
+	keepCDB        bool
+	notifyURL      string
+	auditHistory   int
+	frozen         bool
+	tlsMinVersion  string
+	tlsServerName  string
+	tokenAudience  string
+	httpProxy      string
+	noProxy        string
+	requestTimeout time.Duration
+	connectTimeout time.Duration
+	snapshot       string
 	vars           map[string]string
 }
 
+const pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+
 func readVolumeContext(parameters map[string]string) (*volumeContext, error) {
 	ctx := &volumeContext{
-		uri:  parameters["uri"],
-		vars: make(map[string]string, len(parameters)),
+		uri:           parameters["uri"],
+		endpoint:      parameters["endpoint"],
+		module:        parameters["module"],
+		path:          parameters["path"],
+		format:        parameters["format"],
+		notifyURL:     parameters["notifyURL"],
+		tlsMinVersion: parameters["tlsMinVersion"],
+		tlsServerName: parameters["tlsServerName"],
+		tokenAudience: parameters["serviceAccountTokenAudience"],
+		httpProxy:     parameters["httpProxy"],
+		noProxy:       parameters["noProxy"],
+		snapshot:      parameters["snapshot"],
+		vars:          make(map[string]string, len(parameters)),
+	}
+
+	if volumeContextValidation.strict {
+		if err := checkVolumeContextKeys(parameters); err != nil {
+			return nil, err
+		}
 	}
 
-	if ctx.uri == "" {
-		return nil, status.Error(codes.InvalidArgument, "uri is required")
+	if ctx.uri == "" && ctx.endpoint == "" {
+		return nil, status.Error(codes.InvalidArgument, "uri or endpoint is required")
+	}
+	if ctx.uri != "" && ctx.endpoint != "" {
+		return nil, status.Error(codes.InvalidArgument, "uri and endpoint are mutually exclusive")
+	}
+	if ctx.uri != "" {
+		if err := checkPlainURL("uri", ctx.uri); err != nil {
+			return nil, err
+		}
 	}
 
 	if intervalStr := parameters["updateInterval"]; intervalStr != "" {
@@ -78,18 +196,219 @@ func readVolumeContext(parameters map[string]string) (*volumeContext, error) {
 		ctx.updateInterval = interval
 	}
 
+	if ctx.module != "" && ctx.path != "" {
+		return nil, status.Error(codes.InvalidArgument, "module and path are mutually exclusive")
+	}
+	if ctx.module != "" && (strings.ContainsRune(ctx.module, '/') || ctx.module == "." || ctx.module == "..") {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("module invalid value: %q", ctx.module))
+	}
+	if ctx.path != "" {
+		path := filepath.Clean(ctx.path)
+		if filepath.IsAbs(path) || path == "." || path == ".." || strings.HasPrefix(path, "../") {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("path must be relative to the volume root: %q", ctx.path))
+		}
+		ctx.path = path
+	}
+
+	if _, ok := formatExtensions[ctx.format]; !ok && ctx.format != "" && ctx.format != "cdb" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("format invalid value: %q", ctx.format))
+	}
+	if keepStr := parameters["keepCDB"]; keepStr != "" {
+		keep, err := strconv.ParseBool(keepStr)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("keepCDB invalid value: %v", err))
+		}
+		ctx.keepCDB = keep
+	}
+
+	if ctx.notifyURL != "" {
+		if u, err := url.Parse(ctx.notifyURL); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("notifyURL invalid value: %v", err))
+		} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("notifyURL must be an absolute http or https URL: %q", ctx.notifyURL))
+		} else if strings.HasSuffix(strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")), adminRouteDomain) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("notifyURL must not point to a route of onlineconf-admin: %q", ctx.notifyURL))
+		}
+		if err := checkPlainURL("notifyURL", ctx.notifyURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if historyStr := parameters["auditHistory"]; historyStr != "" {
+		history, err := strconv.ParseUint(historyStr, 10, 16)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("auditHistory invalid value: %v", err))
+		}
+		ctx.auditHistory = int(history)
+	}
+
+	if frozenStr := parameters["frozen"]; frozenStr != "" {
+		frozen, err := strconv.ParseBool(frozenStr)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("frozen invalid value: %v", err))
+		}
+		ctx.frozen = frozen
+	}
+
+	if ctx.snapshot != "" {
+		// nodes serve the content of the snapshot and never poll onlineconf-admin
+		ctx.frozen = true
+	}
+
+	if _, ok := tlsVersions[ctx.tlsMinVersion]; !ok && ctx.tlsMinVersion != "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("tlsMinVersion invalid value: %q", ctx.tlsMinVersion))
+	}
+
+	if ctx.httpProxy != "" {
+		if err := validateProxyURL(ctx.httpProxy); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("httpProxy invalid value: %v", err))
+		}
+	}
+	for _, name := range []string{"requestTimeout", "connectTimeout"} {
+		if timeoutStr := parameters[name]; timeoutStr != "" {
+			timeout, err := time.ParseDuration(timeoutStr)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s invalid value: %v", name, err))
+			}
+			if timeout <= 0 {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s must be positive: %q", name, timeoutStr))
+			}
+			if name == "requestTimeout" {
+				ctx.requestTimeout = timeout
+			} else {
+				ctx.connectTimeout = timeout
+			}
+		}
+	}
+
 	for k, v := range parameters {
 		if strings.HasPrefix(k, "${") && strings.HasSuffix(k, "}") {
 			ctx.vars[k[2:len(k)-1]] = v
 		}
 	}
+
+	if policy := volumeContextValidation.policy; policy != nil {
+		if err := policy.check(ctx); err != nil {
+			return nil, err
+		}
+	}
 	return ctx, nil
 }
 
 func (volCtx *volumeContext) volumeContext() map[string]string {
-	volumeContext := map[string]string{"uri": volCtx.uri}
+	volumeContext := make(map[string]string)
+	if volCtx.uri != "" {
+		volumeContext["uri"] = volCtx.uri
+	}
+	if volCtx.endpoint != "" {
+		volumeContext["endpoint"] = volCtx.endpoint
+	}
+	if volCtx.module != "" {
+		volumeContext["module"] = volCtx.module
+	}
+	if volCtx.path != "" {
+		volumeContext["path"] = volCtx.path
+	}
+	if volCtx.format != "" {
+		volumeContext["format"] = volCtx.format
+	}
+	if volCtx.keepCDB {
+		volumeContext["keepCDB"] = "true"
+	}
+	if volCtx.notifyURL != "" {
+		volumeContext["notifyURL"] = volCtx.notifyURL
+	}
+	if volCtx.auditHistory != 0 {
+		volumeContext["auditHistory"] = strconv.Itoa(volCtx.auditHistory)
+	}
+	if volCtx.frozen {
+		volumeContext["frozen"] = "true"
+	}
+	if volCtx.tlsMinVersion != "" {
+		volumeContext["tlsMinVersion"] = volCtx.tlsMinVersion
+	}
+	if volCtx.tlsServerName != "" {
+		volumeContext["tlsServerName"] = volCtx.tlsServerName
+	}
+	if volCtx.tokenAudience != "" {
+		volumeContext["serviceAccountTokenAudience"] = volCtx.tokenAudience
+	}
+	if volCtx.snapshot != "" {
+		volumeContext["snapshot"] = volCtx.snapshot
+	}
+	if volCtx.httpProxy != "" {
+		volumeContext["httpProxy"] = volCtx.httpProxy
+	}
+	if volCtx.noProxy != "" {
+		volumeContext["noProxy"] = volCtx.noProxy
+	}
+	if volCtx.requestTimeout != 0 {
+		volumeContext["requestTimeout"] = volCtx.requestTimeout.String()
+	}
+	if volCtx.connectTimeout != 0 {
+		volumeContext["connectTimeout"] = volCtx.connectTimeout.String()
+	}
+	if volCtx.updateInterval != 0 {
+		volumeContext["updateInterval"] = volCtx.updateInterval.String()
+	}
 	for k, v := range volCtx.vars {
 		volumeContext["${"+k+"}"] = v
 	}
 	return volumeContext
 }
+
+// validateProxyURL checks that the proxy is an absolute http, https or socks5 URL.
+func validateProxyURL(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" || u.Host == "" {
+		return fmt.Errorf("must be an absolute http, https or socks5 URL: %q", proxy)
+	}
+	return nil
+}
+
+// checkPlainURL returns InvalidArgument if the URL has user info, query or fragment.
+// Credentials are given by secrets, and the rest could hide the real host from policy patterns and readers of PVs.
+func checkPlainURL(name, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s invalid value: %v", name, err))
+	}
+	if u.User != nil || strings.ContainsAny(rawURL, "?#") {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s must not contain user info, query or fragment: %q", name, stripCredentials(rawURL)))
+	}
+	return nil
+}
+
+const (
+	serviceAccountTokensKey = "csi.storage.k8s.io/serviceAccount.tokens"
+	serviceAccountNameKey   = "csi.storage.k8s.io/serviceAccount.name"
+	podNamespaceKey         = "csi.storage.k8s.io/pod.namespace"
+)
+
+// readServiceAccountToken reads the token of the pod requested by kubelet for the audience (see CSIDriver tokenRequests)
+// and the service account it is issued for (see CSIDriver podInfoOnMount).
+func readServiceAccountToken(volumeContext map[string]string, audience string) (podToken, error) {
+	namespace, name := volumeContext[podNamespaceKey], volumeContext[serviceAccountNameKey]
+	if namespace == "" || name == "" {
+		return podToken{}, status.Error(codes.InvalidArgument, fmt.Sprintf("%s or %s missing in volume context, podInfoOnMount must be enabled in CSIDriver", podNamespaceKey, serviceAccountNameKey))
+	}
+	tokensStr, ok := volumeContext[serviceAccountTokensKey]
+	if !ok {
+		return podToken{}, status.Error(codes.InvalidArgument, fmt.Sprintf("%s missing in volume context, tokenRequests must be configured in CSIDriver", serviceAccountTokensKey))
+	}
+	var tokens map[string]struct {
+		Token               string    `json:"token"`
+		ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	}
+	if err := json.Unmarshal([]byte(tokensStr), &tokens); err != nil {
+		return podToken{}, status.Error(codes.InvalidArgument, fmt.Sprintf("%s invalid value: %v", serviceAccountTokensKey, err))
+	}
+	token, ok := tokens[audience]
+	if !ok || token.Token == "" {
+		return podToken{}, status.Error(codes.InvalidArgument, fmt.Sprintf("service account token for audience %q not found", audience))
+	}
+	return podToken{token: token.Token, expires: token.ExpirationTimestamp, serviceAccount: namespace + "/" + name}, nil
+}
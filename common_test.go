@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func mountCapability(flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags},
+		},
+	}
+}
+
+func TestReadVolumeCapability(t *testing.T) {
+	cap, err := readVolumeCapability(mountCapability("mode=750", "gid=1000", "nosuid", "nodev", "noexec", "noatime", `context="system_u:object_r:container_file_t:s0:c1,c2"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cap.chmod || cap.mode != 0750 {
+		t.Errorf("invalid mode: %o", cap.mode)
+	}
+	if !cap.chown || cap.uid != -1 || cap.gid != 1000 {
+		t.Errorf("invalid ownership: %d:%d", cap.uid, cap.gid)
+	}
+	if cap.seLinuxContext != "system_u:object_r:container_file_t:s0:c1,c2" {
+		t.Errorf("invalid context: %q", cap.seLinuxContext)
+	}
+	if flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME); cap.mountFlags != flags {
+		t.Errorf("invalid mount flags: %x != %x", cap.mountFlags, flags)
+	}
+	if len(cap.mountOptions) != 4 {
+		t.Errorf("invalid mount options: %v", cap.mountOptions)
+	}
+
+	for _, flag := range [][]string{{"rw"}, {"mode=999"}, {"uid=-1"}, {"nosuid=1"}, {"context="}, {"relatime", "noatime"}} {
+		_, err := readVolumeCapability(mountCapability(flag...))
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("flags %v: expected InvalidArgument, got %v", flag, err)
+		}
+	}
+
+	for group, gid := range map[string]int{"": -1, "2000": 2000, "1000": 1000, "-1": 0, "x": 0} {
+		volCap := mountCapability("uid=1000")
+		volCap.GetMount().VolumeMountGroup = group
+		if group == "1000" {
+			volCap.GetMount().MountFlags = append(volCap.GetMount().MountFlags, "gid=1000")
+		}
+		cap, err := readVolumeCapability(volCap)
+		if gid == 0 {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("volume_mount_group %q: expected InvalidArgument, got %v", group, err)
+			}
+		} else if err != nil {
+			t.Errorf("volume_mount_group %q: unexpected error: %v", group, err)
+		} else if cap.gid != gid || cap.mountGroup != (group != "") || cap.uid != 1000 {
+			t.Errorf("volume_mount_group %q: invalid ownership: %d:%d", group, cap.uid, cap.gid)
+		}
+	}
+	volCap := mountCapability("gid=1000")
+	volCap.GetMount().VolumeMountGroup = "2000"
+	if _, err := readVolumeCapability(volCap); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("volume_mount_group conflicting with gid flag: unexpected error: %v", err)
+	}
+}
+
+func TestReadServiceAccountToken(t *testing.T) {
+	volumeContext := map[string]string{
+		serviceAccountTokensKey: `{"onlineconf":{"token":"secret","expirationTimestamp":"2030-01-02T03:04:05Z"},"other":{"token":"other"}}`,
+		podNamespaceKey:         "default",
+		serviceAccountNameKey:   "app",
+	}
+	token, err := readServiceAccountToken(volumeContext, "onlineconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.token != "secret" || token.expires != time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC) || token.serviceAccount != "default/app" {
+		t.Errorf("unexpected token: %+v", token)
+	}
+
+	for _, audience := range []string{"unknown", ""} {
+		if _, err := readServiceAccountToken(volumeContext, audience); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("audience %q: unexpected error: %v", audience, err)
+		}
+	}
+	if _, err := readServiceAccountToken(map[string]string{}, "onlineconf"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("missing tokens: unexpected error: %v", err)
+	}
+	delete(volumeContext, serviceAccountNameKey)
+	if _, err := readServiceAccountToken(volumeContext, "onlineconf"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("missing pod info: unexpected error: %v", err)
+	}
+}
+
+func TestReadVolumeContextStrict(t *testing.T) {
+	saved := volumeContextValidation
+	defer func() { volumeContextValidation = saved }()
+	parameters := map[string]string{
+		"uri":                         "http://onlineconf.example.com",
+		"updateIntreval":              "1m",
+		"${namespace":                 "default",
+		"${}":                         "",
+		"${env}":                      "production",
+		"csi.storage.k8s.io/pvc/name": "pvc",
+	}
+
+	if _, err := readVolumeContext(parameters); err != nil {
+		t.Errorf("unknown keys are rejected in non-strict mode: %v", err)
+	}
+	volumeContextValidation.strict = true
+	_, err := readVolumeContext(parameters)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `unknown parameters ["updateIntreval"], malformed variables ["${namespace" "${}"] (must be ${name})`
+	if msg := status.Convert(err).Message(); msg != expected {
+		t.Errorf("unexpected message: %s", msg)
+	}
+	delete(parameters, "updateIntreval")
+	delete(parameters, "${namespace")
+	delete(parameters, "${}")
+	if _, err := readVolumeContext(parameters); err != nil {
+		t.Errorf("valid parameters are rejected: %v", err)
+	}
+
+	policy := &volumePolicy{}
+	if err := policy.setUpdateIntervalLimits(5*time.Second, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	volumeContextValidation.policy = policy
+	for interval, valid := range map[string]bool{"1s": false, "5s": true, "": true, "1m": true, "2m": false} {
+		parameters["updateInterval"] = interval
+		if _, err := readVolumeContext(parameters); valid && err != nil || !valid && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("updateInterval %q: unexpected error: %v", interval, err)
+		}
+	}
+	if err := policy.setUpdateIntervalLimits(20*time.Second, 0); err == nil {
+		t.Error("limits are set both by flags and by the policy")
+	}
+	policy = &volumePolicy{}
+	if err := policy.setUpdateIntervalLimits(20*time.Second, 0); err != nil {
+		t.Fatal(err)
+	}
+	volumeContextValidation.policy = policy
+	parameters["updateInterval"] = ""
+	if _, err := readVolumeContext(parameters); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("default updateInterval is not limited: %v", err)
+	}
+
+	// the volume context of the created volume is checked by nodes against the same limits
+	parameters["updateInterval"] = "1m"
+	resp, err := newControllerServer(nil, nil, nil).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "vol-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         parameters,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volCtx, err := readVolumeContext(resp.GetVolume().GetVolumeContext()); err != nil {
+		t.Errorf("volume context of the created volume is rejected: %v", err)
+	} else if volCtx.updateInterval != time.Minute {
+		t.Errorf("updateInterval is not passed to the volume context: %v", volCtx.updateInterval)
+	}
+}
@@ -2,19 +2,31 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 type controllerServer struct {
 	csi.UnimplementedControllerServer
+	registry  volumeRegistry   // nil if the controller is stateless
+	snapshots snapshotStore    // nil if snapshots are not supported
+	endpoints *endpointAliases // nil if endpoint aliases are not configured, they are checked by nodes then
+	m         sync.Mutex       // serializes creation and deletion of volumes and snapshots
 }
 
-func newControllerServer() *controllerServer {
-	return &controllerServer{}
+func newControllerServer(registry volumeRegistry, snapshots snapshotStore, endpoints *endpointAliases) *controllerServer {
+	return &controllerServer{registry: registry, snapshots: snapshots, endpoints: endpoints}
 }
 
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -33,52 +45,215 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if req.GetCapacityRange() != nil {
 		size = req.GetCapacityRange().GetRequiredBytes()
 	}
-	volCtx, err := readVolumeContext(req.GetParameters())
+	params, source, err := cs.volumeParameters(req)
 	if err != nil {
 		return nil, err
 	}
+	volCtx, err := readVolumeContext(params)
+	if err != nil {
+		return nil, err
+	}
+	if policy := volumeContextValidation.policy; policy != nil {
+		if err := policy.checkNamespace(params[pvcNamespaceKey], volCtx); err != nil {
+			return nil, err
+		}
+		if secrets := req.GetSecrets(); len(secrets) > 0 {
+			if err := policy.checkSecret(params[pvcNamespaceKey], secrets[secretNamespaceKey]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	endpoints := cs.currentEndpoints()
+	if volCtx.endpoint != "" && endpoints != nil {
+		if _, ok := endpoints.get(volCtx.endpoint); !ok {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown endpoint %q", volCtx.endpoint))
+		}
+	}
+
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if cs.registry != nil {
+		existing, err := cs.registry.get(req.GetName())
+		if err != nil {
+			log.Error().Err(err).Str("volume_id", req.GetName()).Msg("failed to read volume registry")
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if existing != nil {
+			if !sameParameters(existing.Parameters, params) || existing.SourceVolumeId != source.SourceVolumeId || existing.SourceSnapshotId != source.SourceSnapshotId {
+				return nil, status.Error(codes.AlreadyExists, "volume already exists with different parameters")
+			}
+			if limit := req.GetCapacityRange().GetLimitBytes(); existing.CapacityBytes < size || limit != 0 && existing.CapacityBytes > limit {
+				return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("volume already exists with incompatible capacity %d", existing.CapacityBytes))
+			}
+			return &csi.CreateVolumeResponse{Volume: existing.volume()}, nil
+		}
+	}
+
+	if secrets := req.GetSecrets(); len(secrets) > 0 {
+		if err := probeAdmin(ctx, volCtx, readCredentials(secrets), endpoints); err != nil {
+			log.Warn().Err(err).Str("name", req.GetName()).Msg("onlineconf-admin probe failed")
+			return nil, err
+		}
+	}
 	for k, v := range volCtx.vars {
 		volCtx.vars[k] = os.Expand(v, func(name string) string {
 			switch name {
 			case "pvc.name":
-				return req.GetParameters()["csi.storage.k8s.io/pvc/name"]
+				return params["csi.storage.k8s.io/pvc/name"]
 			case "pvc.namespace":
-				return req.GetParameters()["csi.storage.k8s.io/pvc/namespace"]
+				return params["csi.storage.k8s.io/pvc/namespace"]
 			case "pv.name":
-				return req.GetParameters()["csi.storage.k8s.io/pv/name"]
+				return params["csi.storage.k8s.io/pv/name"]
 			default:
 				return ""
 			}
 		})
 	}
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			VolumeId:      req.GetName(),
-			VolumeContext: volCtx.volumeContext(),
-			CapacityBytes: size,
-		},
-	}, nil
+	volume := registeredVolume{
+		Id:               req.GetName(),
+		Parameters:       params,
+		VolumeContext:    volCtx.volumeContext(),
+		CapacityBytes:    size,
+		SourceVolumeId:   source.SourceVolumeId,
+		SourceSnapshotId: source.SourceSnapshotId,
+	}
+	if cs.registry != nil {
+		if err := cs.registry.put(volume); err != nil {
+			log.Error().Err(err).Str("volume_id", volume.Id).Msg("failed to register volume")
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return &csi.CreateVolumeResponse{Volume: volume.volume()}, nil
+}
+
+// volumeParameters returns parameters of the volume being created and ids of its content source.
+// A clone inherits parameters of the source volume (except metadata of its PVC and PV) overridden by parameters of the request.
+// A volume created from a snapshot inherits parameters of the snapshotted volume the same way,
+// and is frozen with the content of the snapshot.
+func (cs *controllerServer) volumeParameters(req *csi.CreateVolumeRequest) (map[string]string, registeredVolume, error) {
+	var source registeredVolume
+	var inherited map[string]string
+	if _, ok := req.GetParameters()["snapshot"]; ok {
+		return nil, source, status.Error(codes.InvalidArgument, "snapshot parameter is set from VolumeContentSource only")
+	}
+	switch src := req.GetVolumeContentSource(); {
+	case src == nil:
+		return req.GetParameters(), source, nil
+	case src.GetVolume() != nil:
+		if cs.registry == nil {
+			return nil, source, status.Error(codes.InvalidArgument, "volume cloning requires volume registry")
+		}
+		if src.GetVolume().GetVolumeId() == "" {
+			return nil, source, status.Error(codes.InvalidArgument, "VolumeId of VolumeContentSource missing in request")
+		}
+		volume, err := cs.getVolume(src.GetVolume().GetVolumeId())
+		if err != nil {
+			return nil, source, err
+		}
+		source.SourceVolumeId = volume.Id
+		inherited = volume.Parameters
+	case src.GetSnapshot() != nil:
+		if cs.snapshots == nil {
+			return nil, source, status.Error(codes.InvalidArgument, "snapshots are not supported without snapshot store")
+		}
+		if src.GetSnapshot().GetSnapshotId() == "" {
+			return nil, source, status.Error(codes.InvalidArgument, "SnapshotId of VolumeContentSource missing in request")
+		}
+		snapshot, err := cs.getSnapshot(src.GetSnapshot().GetSnapshotId())
+		if err != nil {
+			return nil, source, err
+		}
+		if snapshot.Namespace != req.GetParameters()[pvcNamespaceKey] {
+			return nil, source, status.Error(codes.PermissionDenied, "snapshot belongs to another namespace")
+		}
+		source.SourceSnapshotId = snapshot.Id
+		inherited = snapshot.Parameters
+	default:
+		return nil, source, status.Error(codes.InvalidArgument, "unsupported VolumeContentSource")
+	}
+
+	params := make(map[string]string, len(inherited)+len(req.GetParameters())+2)
+	for k, v := range inherited {
+		if !strings.HasPrefix(k, "csi.storage.k8s.io/") {
+			params[k] = v
+		}
+	}
+	for k, v := range req.GetParameters() {
+		params[k] = v
+	}
+	if source.SourceSnapshotId != "" {
+		params["snapshot"] = source.SourceSnapshotId
+		params["frozen"] = "true"
+	}
+	return params, source, nil
+}
+
+func (v *registeredVolume) volume() *csi.Volume {
+	volume := &csi.Volume{
+		VolumeId:      v.Id,
+		VolumeContext: v.VolumeContext,
+		CapacityBytes: v.CapacityBytes,
+	}
+	if v.SourceVolumeId != "" {
+		volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: v.SourceVolumeId},
+			},
+		}
+	}
+	if v.SourceSnapshotId != "" {
+		volume.ContentSource = &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: v.SourceSnapshotId},
+			},
+		}
+	}
+	return volume
+}
+
+func sameParameters(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
 }
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "VolumeId missing in request")
 	}
+	if cs.registry != nil {
+		cs.m.Lock()
+		defer cs.m.Unlock()
+		if err := cs.registry.delete(req.GetVolumeId()); err != nil {
+			log.Error().Err(err).Str("volume_id", req.GetVolumeId()).Msg("failed to unregister volume")
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	return &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
-				},
+	rpcs := []csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME}
+	if cs.registry != nil {
+		rpcs = append(rpcs,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		)
+		if cs.snapshots != nil {
+			rpcs = append(rpcs, csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT, csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS)
+		}
+	}
+	capabilities := make([]*csi.ControllerServiceCapability, 0, len(rpcs))
+	for _, rpc := range rpcs {
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: rpc},
 			},
-		},
-	}, nil
+		})
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -88,6 +263,11 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "VolumeCapabilities missing in request")
 	}
+	if cs.registry != nil {
+		if _, err := cs.getVolume(req.GetVolumeId()); err != nil {
+			return nil, err
+		}
+	}
 	for _, volCap := range req.GetVolumeCapabilities() {
 		if _, err := readVolumeCapability(volCap); err != nil {
 			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
@@ -109,3 +289,226 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		},
 	}, nil
 }
+
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if cs.registry == nil {
+		return nil, status.Error(codes.Unimplemented, "volume registry is not configured")
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "MaxEntries must not be negative")
+	}
+	volumes, err := cs.registry.list()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list volume registry")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	start, end, err := paginate(len(volumes), func(i int) string { return volumes[i].Id }, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.ListVolumesResponse{Entries: make([]*csi.ListVolumesResponse_Entry, 0, end-start)}
+	for i := start; i < end; i++ {
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{Volume: volumes[i].volume()})
+	}
+	if end < len(volumes) {
+		resp.NextToken = volumes[end].Id
+	}
+	return resp, nil
+}
+
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if cs.registry == nil {
+		return nil, status.Error(codes.Unimplemented, "volume registry is not configured")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumeId missing in request")
+	}
+	volume, err := cs.getVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volume.volume(),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{},
+	}, nil
+}
+
+// getVolume returns the registered volume or NotFound error.
+func (cs *controllerServer) getVolume(id string) (*registeredVolume, error) {
+	volume, err := cs.registry.get(id)
+	if err != nil {
+		log.Error().Err(err).Str("volume_id", id).Msg("failed to read volume registry")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if volume == nil {
+		return nil, status.Error(codes.NotFound, "volume not found")
+	}
+	return volume, nil
+}
+
+// paginate returns bounds of the page of n entries ordered by id.
+// The token is the id of the first entry of the page.
+func paginate(n int, id func(int) string, token string, maxEntries int32) (int, int, error) {
+	start := 0
+	if token != "" {
+		start = sort.Search(n, func(i int) bool { return id(i) >= token })
+		if start == n || id(start) != token {
+			return 0, 0, status.Error(codes.Aborted, fmt.Sprintf("invalid StartingToken: %q", token))
+		}
+	}
+	end := n
+	if max := int(maxEntries); max > 0 && start+max < end {
+		end = start + max
+	}
+	return start, end, nil
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if cs.snapshots == nil || cs.registry == nil {
+		return nil, status.Error(codes.Unimplemented, "snapshot store is not configured")
+	}
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
+	}
+
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	existing, err := cs.snapshots.get(req.GetName())
+	if err != nil {
+		log.Error().Err(err).Str("snapshot_id", req.GetName()).Msg("failed to read snapshot store")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if existing != nil {
+		if existing.SourceVolumeId != req.GetSourceVolumeId() {
+			return nil, status.Error(codes.AlreadyExists, "snapshot already exists for another volume")
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: existing.snapshot()}, nil
+	}
+
+	volume, err := cs.getVolume(req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	volCtx, err := readVolumeContext(volume.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if volCtx.snapshot != "" {
+		return nil, status.Error(codes.InvalidArgument, "volume created from a snapshot can't be snapshotted")
+	}
+	namespace := volume.Parameters[pvcNamespaceKey]
+	if namespace == "" {
+		return nil, status.Error(codes.FailedPrecondition, "namespace of the source volume is unknown, the provisioner must be run with --extra-create-metadata")
+	}
+	if policy := volumeContextValidation.policy; policy != nil {
+		if err := policy.checkSecret(namespace, req.GetSecrets()[secretNamespaceKey]); err != nil {
+			return nil, err
+		}
+	}
+	creds := readCredentials(req.GetSecrets())
+	if err := creds.validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid snapshotter secret: %v", err))
+	}
+	if creds.tokenFile != "" || volCtx.tokenAudience != "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshotter secret must contain username and password or token, other credentials are available on the node only")
+	}
+	data, err := fetchAdminConfig(ctx, volCtx, creds, cs.currentEndpoints())
+	if err != nil {
+		log.Warn().Err(err).Str("snapshot_id", req.GetName()).Str("volume_id", volume.Id).Msg("failed to fetch snapshot data")
+		return nil, err
+	}
+	if _, err := decodeConfigData(data); err != nil {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("invalid response of onlineconf-admin %s: %v", volCtx.uri, err))
+	}
+
+	snapshot := storedSnapshot{
+		Id:             req.GetName(),
+		SourceVolumeId: volume.Id,
+		Parameters:     volume.Parameters,
+		Namespace:      namespace,
+		CreationTime:   time.Now(),
+		SizeBytes:      int64(len(data)),
+	}
+	if err := cs.snapshots.put(snapshot, data); err != nil {
+		log.Error().Err(err).Str("snapshot_id", snapshot.Id).Msg("failed to store snapshot")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Info().Str("snapshot_id", snapshot.Id).Str("volume_id", volume.Id).Int64("size", snapshot.SizeBytes).Msg("snapshot created")
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot.snapshot()}, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if cs.snapshots == nil {
+		return nil, status.Error(codes.Unimplemented, "snapshot store is not configured")
+	}
+	if req.GetSnapshotId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "SnapshotId missing in request")
+	}
+	cs.m.Lock()
+	defer cs.m.Unlock()
+	if err := cs.snapshots.delete(req.GetSnapshotId()); err != nil {
+		log.Error().Err(err).Str("snapshot_id", req.GetSnapshotId()).Msg("failed to delete snapshot")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if cs.snapshots == nil {
+		return nil, status.Error(codes.Unimplemented, "snapshot store is not configured")
+	}
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "MaxEntries must not be negative")
+	}
+	all, err := cs.snapshots.list()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list snapshot store")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	snapshots := all[:0]
+	for _, s := range all {
+		if (req.GetSnapshotId() == "" || s.Id == req.GetSnapshotId()) && (req.GetSourceVolumeId() == "" || s.SourceVolumeId == req.GetSourceVolumeId()) {
+			snapshots = append(snapshots, s)
+		}
+	}
+
+	start, end, err := paginate(len(snapshots), func(i int) string { return snapshots[i].Id }, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.ListSnapshotsResponse{Entries: make([]*csi.ListSnapshotsResponse_Entry, 0, end-start)}
+	for i := start; i < end; i++ {
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshots[i].snapshot()})
+	}
+	if end < len(snapshots) {
+		resp.NextToken = snapshots[end].Id
+	}
+	return resp, nil
+}
+
+// getSnapshot returns the stored snapshot or NotFound error.
+func (cs *controllerServer) getSnapshot(id string) (*storedSnapshot, error) {
+	snapshot, err := cs.snapshots.get(id)
+	if err != nil {
+		log.Error().Err(err).Str("snapshot_id", id).Msg("failed to read snapshot store")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if snapshot == nil {
+		return nil, status.Error(codes.NotFound, "snapshot not found")
+	}
+	return snapshot, nil
+}
+
+func (s *storedSnapshot) snapshot() *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     s.Id,
+		SourceVolumeId: s.SourceVolumeId,
+		SizeBytes:      s.SizeBytes,
+		CreationTime:   &timestamp.Timestamp{Seconds: s.CreationTime.Unix(), Nanos: int32(s.CreationTime.Nanosecond())},
+		ReadyToUse:     true,
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// credentialKeys are keys of node-stage secrets used to connect to onlineconf-admin.
+var credentialKeys = []string{"username", "password", "token", "tokenFile", "ca.crt", "tls.crt", "tls.key"}
+
+func isCredentialKey(key string) bool {
+	for _, k := range credentialKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// secretNamespaceKey is a key of secrets declaring the namespace they belong to.
+// Requests carry contents of secrets but not their references, so the owner of a secret declares its namespace,
+// and secrets referenced from other namespaces are rejected by secretNamespaces rules of the policy.
+const secretNamespaceKey = "namespace"
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+const secretsScanInterval = 10 * time.Second
+
+// adminCredentials are secrets of a volume used to connect to onlineconf-admin.
+type adminCredentials struct {
+	username   string
+	password   string
+	token      string
+	tokenFile  string
+	caCert     string
+	clientCert string
+	clientKey  string
+}
+
+func readCredentials(secrets map[string]string) adminCredentials {
+	return adminCredentials{
+		username:   secrets["username"],
+		password:   secrets["password"],
+		token:      secrets["token"],
+		tokenFile:  secrets["tokenFile"],
+		caCert:     secrets["ca.crt"],
+		clientCert: secrets["tls.crt"],
+		clientKey:  secrets["tls.key"],
+	}
+}
+
+func (creds adminCredentials) validate() error {
+	if creds.token != "" && creds.tokenFile != "" {
+		return errors.New("token and tokenFile are mutually exclusive")
+	}
+	if creds.tokenFile != "" && (!filepath.IsAbs(creds.tokenFile) || hasDotDot(creds.tokenFile)) {
+		return fmt.Errorf("tokenFile must be an absolute path without \"..\": %q", creds.tokenFile)
+	}
+	settings := transportSettings{caCert: creds.caCert, clientCert: creds.clientCert, clientKey: creds.clientKey}
+	if _, err := settings.tlsConfig(); err != nil {
+		return fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	return nil
+}
+
+// tokenFileDir is a directory token files of volumes are confined to, it is set from -token-dir flag on startup.
+// The files are read by the driver running as root on the node, so tokenFile secrets are rejected if it is empty.
+var tokenFileDir string
+
+// checkTokenFile returns the token file with symlinks resolved or an error if it is outside of tokenFileDir.
+// A file which doesn't exist yet is checked without resolving, it is checked again before every read.
+func checkTokenFile(file string) (string, error) {
+	if tokenFileDir == "" {
+		return "", errors.New("tokenFile is not allowed, the driver is started without -token-dir")
+	}
+	if !filepath.IsAbs(file) || hasDotDot(file) {
+		return "", fmt.Errorf("tokenFile must be an absolute path without \"..\": %q", file)
+	}
+	if !isWithinDir(filepath.Clean(tokenFileDir), filepath.Clean(file)) {
+		return "", fmt.Errorf("tokenFile must be inside %s: %q", tokenFileDir, file)
+	}
+	resolved, err := filepath.EvalSymlinks(file)
+	if os.IsNotExist(err) {
+		return file, nil
+	} else if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(tokenFileDir)
+	if err != nil {
+		return "", err
+	}
+	if !isWithinDir(dir, resolved) {
+		return "", fmt.Errorf("tokenFile resolves to a path outside of %s: %q", tokenFileDir, file)
+	}
+	return resolved, nil
+}
+
+func hasDotDot(file string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(file), "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithinDir reports whether the clean absolute path is inside the clean absolute directory.
+func isWithinDir(dir, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (state *updaterState) credentials() adminCredentials {
+	return adminCredentials{
+		username:   state.Username,
+		password:   state.Password,
+		token:      state.Token,
+		tokenFile:  state.TokenFile,
+		caCert:     state.CACert,
+		clientCert: state.TLSCert,
+		clientKey:  state.TLSKey,
+	}
+}
+
+func (state *updaterState) setCredentials(creds adminCredentials) {
+	state.Username = creds.username
+	state.Password = creds.password
+	state.Token = creds.token
+	state.TokenFile = creds.tokenFile
+	state.CACert = creds.caCert
+	state.TLSCert = creds.clientCert
+	state.TLSKey = creds.clientKey
+}
+
+// setCredentials replaces credentials of the staged volume, persists them and applies them to the running updater.
+// It returns whether the credentials have been changed.
+func (ns *nodeServer) setCredentials(volumeId string, creds adminCredentials) (bool, error) {
+	ns.m.Lock()
+	defer ns.m.Unlock()
+	return ns.setCredentialsLocked(volumeId, creds)
+}
+
+func (ns *nodeServer) setCredentialsLocked(volumeId string, creds adminCredentials) (bool, error) {
+	us, ok := ns.state.Updaters[volumeId]
+	if !ok {
+		return false, errVolumeNotFound
+	}
+	if _, ok := ns.busy[volumeId]; ok {
+		return false, errVolumeBusy
+	}
+	if us.credentials() == creds {
+		return false, nil
+	}
+	if err := creds.validate(); err != nil {
+		return false, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+	}
+	if us.TokenAudience != "" && (creds.token != "" || creds.tokenFile != "") {
+		return false, fmt.Errorf("%w: serviceAccountTokenAudience is mutually exclusive with token and tokenFile", errInvalidCredentials)
+	}
+	if creds.tokenFile != "" {
+		if _, err := checkTokenFile(creds.tokenFile); err != nil {
+			return false, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+		}
+	}
+
+	us.setCredentials(creds)
+	if ui := ns.updaters[us.DataDir]; ui != nil {
+		if err := ns.router.update(ui.routeURI, ns.config.withDefaults(us)); err != nil {
+			return false, err
+		}
+		ui.m.Lock()
+		ui.state.setCredentials(creds)
+		ui.m.Unlock()
+	}
+	ns.state.Updaters[volumeId] = us
+	if err := ns.state.save(); err != nil {
+		return true, err
+	}
+	log.Info().Str("volume_id", volumeId).Msg("credentials updated")
+	return true, nil
+}
+
+// watchSecrets periodically reads credentials of staged volumes from files "<secretsDir>/<volumeId>/<key>"
+// (e.g. projected secret volumes) and applies them if they are changed.
+func (ns *nodeServer) watchSecrets() {
+	defer ns.wg.Done()
+	ticker := time.NewTicker(secretsScanInterval)
+	defer ticker.Stop()
+	for {
+		ns.scanSecrets()
+		select {
+		case <-ns.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ns *nodeServer) scanSecrets() {
+	ns.m.Lock()
+	volumeIds := make([]string, 0, len(ns.state.Updaters))
+	for volumeId := range ns.state.Updaters {
+		volumeIds = append(volumeIds, volumeId)
+	}
+	ns.m.Unlock()
+
+	for _, volumeId := range volumeIds {
+		dir := filepath.Join(ns.config.secretsDir, url.PathEscape(volumeId))
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		secrets := make(map[string]string, len(credentialKeys))
+		for _, key := range credentialKeys {
+			if content, err := ioutil.ReadFile(filepath.Join(dir, key)); err == nil {
+				secrets[key] = string(content)
+			} else if !os.IsNotExist(err) {
+				log.Error().Err(err).Str("volume_id", volumeId).Str("key", key).Msg("failed to read secret")
+				secrets = nil
+				break
+			}
+		}
+		if secrets == nil {
+			continue
+		}
+		if _, err := ns.setCredentials(volumeId, readCredentials(secrets)); err != nil && err != errVolumeNotFound && err != errVolumeBusy {
+			log.Error().Err(err).Str("volume_id", volumeId).Msg("failed to update credentials from secrets directory")
+		}
+	}
+}
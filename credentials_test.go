@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetCredentials(t *testing.T) {
+	ns, dir := testNodeServer(t)
+	defer os.RemoveAll(dir)
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+	}))
+	defer server.Close()
+
+	ui := testStageVolume(t, ns, dir, "vol-1")
+	state := ns.state.Updaters["vol-1"]
+	state.URI = server.URL
+	state.Username, state.Password = "user", "old"
+	ns.state.Updaters["vol-1"] = state
+	routeURI, err := ns.router.add(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.router.remove(routeURI)
+	ui.routeURI = routeURI
+	get := func() {
+		resp, err := (&http.Client{Transport: ns.router}).Get(routeURI + "/client/config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if changed, err := ns.setCredentials("vol-1", adminCredentials{username: "user", password: "old"}); changed || err != nil {
+		t.Errorf("unchanged credentials: %v, %v", changed, err)
+	}
+	if _, err := ns.setCredentials("vol-1", adminCredentials{token: "a", tokenFile: "/b"}); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("invalid credentials: unexpected error: %v", err)
+	}
+	if _, err := ns.setCredentials("unknown", adminCredentials{}); err != errVolumeNotFound {
+		t.Errorf("unknown volume: unexpected error: %v", err)
+	}
+
+	if changed, err := ns.setCredentials("vol-1", adminCredentials{username: "user", password: "new"}); !changed || err != nil {
+		t.Fatalf("credentials are not changed: %v", err)
+	}
+	get()
+	if username != "user" || password != "new" {
+		t.Errorf("new credentials are not applied: %q:%q", username, password)
+	}
+	saved, err := readState(ns.state.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Updaters["vol-1"].Password != "new" {
+		t.Error("new credentials are not persisted")
+	}
+	if fi, err := os.Stat(ns.state.path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("state file is not private: %v, %v", fi.Mode(), err)
+	}
+
+	ns.config.secretsDir = filepath.Join(dir, "secrets")
+	if err := os.MkdirAll(filepath.Join(ns.config.secretsDir, "vol-1"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"username": "rotated", "password": "secret"} {
+		if err := ioutil.WriteFile(filepath.Join(ns.config.secretsDir, "vol-1", key), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ns.scanSecrets()
+	get()
+	if username != "rotated" || password != "secret" {
+		t.Errorf("credentials from secrets directory are not applied: %q:%q", username, password)
+	}
+
+	admin := httptest.NewServer(newAdminServer(ns, "").server.Handler)
+	defer admin.Close()
+	put := func(body string) int {
+		req, _ := http.NewRequest(http.MethodPut, admin.URL+"/volumes/vol-1/credentials", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := put(`{"username": "admin", "password": "api"}`); code != http.StatusNoContent {
+		t.Errorf("unexpected status: %d", code)
+	}
+	get()
+	if username != "admin" || password != "api" {
+		t.Errorf("credentials from admin API are not applied: %q:%q", username, password)
+	}
+	if code := put(`{"user": "admin"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown key: unexpected status: %d", code)
+	}
+	if code := put(`{"tls.crt": "invalid"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid credentials: unexpected status: %d", code)
+	}
+}
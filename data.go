@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var errDataNotFound = errors.New("requested data not found")
+
+// volumeData maps file paths relative to the volume root to their content.
+type volumeData map[string][]byte
+
+// readVolumeData reads the updater output from the working directory and
+// selects the part of it requested by the module or path volume attribute.
+func readVolumeData(state updaterState) (volumeData, error) {
+	data := volumeData{}
+	root := state.WorkDir
+	if state.Path != "" {
+		root = filepath.Join(root, state.Path)
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		name := filepath.Base(path)
+		if path != root {
+			name, _ = filepath.Rel(root, path)
+		}
+		if state.Module != "" && strings.TrimSuffix(name, filepath.Ext(name)) != state.Module {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		data[name] = content
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 && (state.Module != "" || state.Path != "") {
+		return data, errDataNotFound
+	}
+	return data, nil
+}
+
+// writeVolumeData makes the content of dir exactly match data.
+// Modified files are replaced atomically, unmodified ones are left intact.
+func writeVolumeData(dir string, data volumeData) error {
+	for name, content := range data {
+		path := filepath.Join(dir, name)
+		if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, content) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		name, _ := filepath.Rel(dir, path)
+		if _, ok := data[name]; !ok {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		if err := os.Remove(d); err != nil && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmpfile := path + ".tmp"
+	if err := ioutil.WriteFile(tmpfile, content, perm); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	if err := os.Rename(tmpfile, path); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+// setTreeAttributes applies ownership and SELinux label requested by mount flags
+// to the data directory and everything inside it.
+func setTreeAttributes(root string, state updaterState) error {
+	if !state.Chown && state.SELinuxContext == "" {
+		return nil
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return setPathAttributes(path, state)
+	})
+}
+
+func setPathAttributes(path string, state updaterState) error {
+	if state.Chown {
+		if err := os.Lchown(path, state.UID, state.GID); err != nil {
+			return err
+		}
+	}
+	if state.SELinuxContext != "" {
+		if err := unix.Lsetxattr(path, "security.selinux", []byte(state.SELinuxContext), 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeData(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "onlineconf-csi-work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	dataDir, err := ioutil.TempDir("", "onlineconf-csi-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	for _, name := range []string{"TREE.cdb", "TREE.conf", "my-service.cdb", "my-service.conf"} {
+		if err := ioutil.WriteFile(filepath.Join(workDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := readVolumeData(updaterState{WorkDir: workDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4 {
+		t.Errorf("invalid data: %v", data)
+	}
+
+	data, err = readVolumeData(updaterState{WorkDir: workDir, Module: "my-service"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || string(data["my-service.cdb"]) != "my-service.cdb" {
+		t.Errorf("invalid module data: %v", data)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "stale.cdb"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeVolumeData(dataDir, data); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != "my-service.cdb" || files[1].Name() != "my-service.conf" {
+		t.Errorf("invalid data directory content: %v", files)
+	}
+
+	data, err = readVolumeData(updaterState{WorkDir: workDir, Path: "TREE.cdb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || string(data["TREE.cdb"]) != "TREE.cdb" {
+		t.Errorf("invalid path data: %v", data)
+	}
+
+	if _, err := readVolumeData(updaterState{WorkDir: workDir, Module: "missing"}); err != errDataNotFound {
+		t.Errorf("expected errDataNotFound, got %v", err)
+	}
+}
+
+func TestRenderDataNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onlineconf-csi-render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ui := testUpdaterInfo(t, dir, "http://onlineconf.example.com", "vol-1")
+	ui.state.Module = "TREE"
+	conf := filepath.Join(ui.state.WorkDir, "TREE.conf")
+	if err := ioutil.WriteFile(conf, []byte("a 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ui.m.Lock()
+	defer ui.m.Unlock()
+	if err := ui.render(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ui.render(); err != errDataNotFound {
+		t.Errorf("expected errDataNotFound, got %v", err)
+	}
+	if gen, err := currentGeneration(ui.state.DataDir); err != nil || gen != 1 || ui.status.Generation != 1 {
+		t.Errorf("current generation is not kept: %d, %d, %v", gen, ui.status.Generation, err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(ui.state.DataDir, "TREE.conf")); err != nil || string(content) != "a 1\n" {
+		t.Errorf("volume content is wiped: %q, %v", content, err)
+	}
+}
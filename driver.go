@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/url"
 	"os"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
@@ -15,6 +17,7 @@ import (
 type driver struct {
 	server *grpc.Server
 	ns     *nodeServer
+	admin  *adminServer
 }
 
 func newDriver() *driver {
@@ -23,36 +26,33 @@ func newDriver() *driver {
 	return &driver{server: server}
 }
 
-func (d *driver) initControllerServer() {
-	csi.RegisterControllerServer(d.server, newControllerServer())
+func (d *driver) initControllerServer(registry volumeRegistry, snapshots snapshotStore, endpoints *endpointAliases) {
+	csi.RegisterControllerServer(d.server, newControllerServer(registry, snapshots, endpoints))
 }
 
-func (d *driver) initNodeServer(id, stateFile string) (err error) {
-	d.ns, err = newNodeServer(id, stateFile)
+func (d *driver) initNodeServer(id string, config nodeConfig) (err error) {
+	d.ns, err = newNodeServer(id, config)
 	if err == nil {
 		csi.RegisterNodeServer(d.server, d.ns)
 	}
 	return
 }
 
+func (d *driver) initAdminServer(endpoint string) {
+	d.admin = newAdminServer(d.ns, endpoint)
+}
+
 func (d *driver) run(endpoint string) {
 	if d.ns != nil {
 		d.ns.start()
 		defer d.ns.stop()
 	}
-
-	uri, err := url.Parse(endpoint)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to parse endpoint")
+	if d.admin != nil {
+		go d.admin.run()
+		defer d.admin.stop()
 	}
 
-	if uri.Scheme == "unix" {
-		if err := os.Remove(uri.Path); err != nil && !os.IsNotExist(err) {
-			log.Fatal().Err(err).Str("addr", uri.Path).Msg("failed to remove socket")
-		}
-	}
-
-	listener, err := net.Listen(uri.Scheme, uri.Path)
+	listener, err := listen(endpoint)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to listen")
 	}
@@ -67,11 +67,44 @@ func (d *driver) stop() {
 	d.server.Stop()
 }
 
+func listen(endpoint string) (net.Listener, error) {
+	uri, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint: %w", err)
+	}
+
+	addr := uri.Path
+	if uri.Scheme == "unix" {
+		if err := os.Remove(uri.Path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove socket %s: %w", uri.Path, err)
+		}
+	} else {
+		addr = uri.Host
+	}
+
+	return net.Listen(uri.Scheme, addr)
+}
+
 func loggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 	resp, err = handler(ctx, req)
 	log.Info().Str("method", info.FullMethod).
-		Str("request", protosanitizer.StripSecrets(req).String()).
+		Str("request", protosanitizer.StripSecrets(stripPodTokens(req)).String()).
 		Str("response", protosanitizer.StripSecrets(resp).String()).
 		Err(err).Msg("request finished")
 	return
 }
+
+// stripPodTokens returns a copy of NodePublishVolumeRequest with service account tokens of the pod hidden.
+// They are passed in the volume context, which isn't marked as secret in the CSI spec.
+func stripPodTokens(req interface{}) interface{} {
+	publish, ok := req.(*csi.NodePublishVolumeRequest)
+	if !ok {
+		return req
+	}
+	if _, ok := publish.GetVolumeContext()[serviceAccountTokensKey]; !ok {
+		return req
+	}
+	publish = proto.Clone(publish).(*csi.NodePublishVolumeRequest)
+	publish.VolumeContext[serviceAccountTokensKey] = "***stripped***"
+	return publish
+}
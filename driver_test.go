@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+func TestLoggingInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	saved := log.Logger
+	defer func() { log.Logger = saved }()
+	log.Logger = zerolog.New(&buf)
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:      "vol-1",
+		VolumeContext: map[string]string{serviceAccountTokensKey: `{"onlineconf":{"token":"pod-token"}}`, podNamespaceKey: "default"},
+		Secrets:       map[string]string{"password": "stage-secret"},
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+	if _, err := loggingInterceptor(context.Background(), req, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	line := buf.String()
+	if strings.Contains(line, "pod-token") || strings.Contains(line, "stage-secret") {
+		t.Errorf("secrets are logged: %s", line)
+	}
+	if !strings.Contains(line, "vol-1") || !strings.Contains(line, "default") {
+		t.Errorf("request is not logged: %s", line)
+	}
+	if !strings.Contains(req.VolumeContext[serviceAccountTokensKey], "pod-token") {
+		t.Error("tokens are stripped from the request passed to the handler")
+	}
+}
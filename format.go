@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/colinmarc/cdb"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+var formatExtensions = map[string]string{
+	"json":       ".json",
+	"yaml":       ".yaml",
+	"env":        ".env",
+	"properties": ".properties",
+}
+
+type moduleParam struct {
+	path  string
+	json  bool
+	value string
+}
+
+// convertVolumeData converts every module of the updater output into the requested format.
+// The original .cdb files are kept in the result if keepCDB is set, .conf files are always dropped.
+func convertVolumeData(data volumeData, format string, keepCDB bool) (volumeData, error) {
+	ext, ok := formatExtensions[format]
+	if !ok {
+		return data, nil
+	}
+	result := make(volumeData, len(data))
+	for name, content := range data {
+		switch filepath.Ext(name) {
+		case ".cdb":
+			params, err := readModuleParams(content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			converted, err := formatModuleParams(params, format)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert %s: %w", name, err)
+			}
+			result[strings.TrimSuffix(name, ".cdb")+ext] = converted
+			if keepCDB {
+				result[name] = content
+			}
+		case ".conf":
+		default:
+			result[name] = content
+		}
+	}
+	return result, nil
+}
+
+func readModuleParams(content []byte) ([]moduleParam, error) {
+	db, err := cdb.New(bytes.NewReader(content), nil)
+	if err != nil {
+		return nil, err
+	}
+	var params []moduleParam
+	iter := db.Iter()
+	for iter.Next() {
+		value := iter.Value()
+		if len(value) == 0 {
+			continue
+		}
+		params = append(params, moduleParam{
+			path:  string(iter.Key()),
+			json:  value[0] == 'j',
+			value: string(value[1:]),
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].path < params[j].path
+	})
+	return params, nil
+}
+
+func formatModuleParams(params []moduleParam, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		tree, err := buildParamTree(params, func(p moduleParam) (interface{}, error) {
+			if p.json {
+				return json.RawMessage(p.value), nil
+			}
+			return p.value, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		obj := tree.convert(func(names []string, values []interface{}) interface{} {
+			m := make(map[string]interface{}, len(names))
+			for i, name := range names {
+				m[name] = values[i]
+			}
+			return m
+		})
+		content, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(content, '\n'), nil
+	case "yaml":
+		tree, err := buildParamTree(params, func(p moduleParam) (interface{}, error) {
+			var value interface{} = p.value
+			if p.json {
+				if err := yaml.Unmarshal([]byte(p.value), &value); err != nil {
+					return nil, err
+				}
+			}
+			return value, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(tree.convert(func(names []string, values []interface{}) interface{} {
+			m := make(yaml.MapSlice, len(names))
+			for i, name := range names {
+				m[i] = yaml.MapItem{Key: name, Value: values[i]}
+			}
+			return m
+		}))
+	case "env":
+		var buf bytes.Buffer
+		seen := make(map[string]string, len(params))
+		for _, p := range params {
+			name := envName(p.path)
+			if other, ok := seen[name]; ok {
+				log.Warn().Str("param", p.path).Str("other", other).Str("name", name).Msg("duplicate environment variable name, parameter skipped")
+				continue
+			}
+			seen[name] = p.path
+			buf.WriteString(name)
+			buf.WriteString("='")
+			buf.WriteString(strings.Replace(p.value, "'", `'\''`, -1))
+			buf.WriteString("'\n")
+		}
+		return buf.Bytes(), nil
+	case "properties":
+		var buf bytes.Buffer
+		for _, p := range params {
+			buf.WriteString(escapeProperty(p.path, true))
+			buf.WriteString("=")
+			buf.WriteString(escapeProperty(p.value, false))
+			buf.WriteString("\n")
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported format: %q", format)
+	}
+}
+
+// paramTree is a tree of parameters split by "/" of their paths, it is written by structured formats.
+// A parameter with children is written as an object with its own value under the empty key.
+type paramTree struct {
+	value    interface{}
+	hasValue bool
+	children map[string]*paramTree
+}
+
+func buildParamTree(params []moduleParam, value func(moduleParam) (interface{}, error)) (*paramTree, error) {
+	root := &paramTree{}
+	for _, p := range params {
+		node := root
+		for _, name := range strings.Split(p.path, "/") {
+			if name == "" {
+				continue
+			}
+			child, ok := node.children[name]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[string]*paramTree)
+				}
+				child = &paramTree{}
+				node.children[name] = child
+			}
+			node = child
+		}
+		v, err := value(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.path, err)
+		}
+		node.value = v
+		node.hasValue = true
+	}
+	return root, nil
+}
+
+// convert returns the value of a leaf or an object made by the function from sorted names and converted values of children.
+func (t *paramTree) convert(object func(names []string, values []interface{}) interface{}) interface{} {
+	if len(t.children) == 0 {
+		return t.value
+	}
+	names := make([]string, 0, len(t.children)+1)
+	for name := range t.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]interface{}, 0, len(names)+1)
+	for _, name := range names {
+		values = append(values, t.children[name].convert(object))
+	}
+	if t.hasValue {
+		names = append([]string{""}, names...)
+		values = append([]interface{}{t.value}, values...)
+	}
+	return object(names, values)
+}
+
+// envName converts a parameter path into a shell compatible variable name: "/a/b-c" => "A_B_C".
+func envName(path string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return unicode.ToUpper(r)
+		} else if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.TrimLeft(path, "/."))
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// escapeProperty escapes a key or a value according to java.util.Properties rules.
+func escapeProperty(s string, key bool) string {
+	var buf strings.Builder
+	for i, r := range s {
+		switch r {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '=', ':', '#', '!':
+			if key {
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(r)
+		case ' ':
+			if key || i == 0 {
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(r)
+		default:
+			if r < 0x20 || r > 0x7e {
+				if r > 0xffff {
+					r1, r2 := utf16.EncodeRune(r)
+					fmt.Fprintf(&buf, `\u%04x\u%04x`, r1, r2)
+				} else {
+					fmt.Fprintf(&buf, `\u%04x`, r)
+				}
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/colinmarc/cdb"
+)
+
+func testModuleCDB(t *testing.T, params map[string]string) []byte {
+	f, err := ioutil.TempFile("", "onlineconf-csi-*.cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	w, err := cdb.Create(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range params {
+		if err := w.Put([]byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestConvertVolumeData(t *testing.T) {
+	data := volumeData{
+		"TREE.cdb": testModuleCDB(t, map[string]string{ // values are prefixed with type: s - string, j - JSON
+			"/db":         "s" + "primary",
+			"/db/host":    "s" + "db.example.com",
+			"/db/options": "j" + `{"timeout":5}`,
+			"/motd":       "s" + "it's = fine\n",
+		}),
+		"TREE.conf": []byte("..."),
+	}
+
+	expected := map[string]string{
+		"json": `{
+  "db": {
+    "": "primary",
+    "host": "db.example.com",
+    "options": {
+      "timeout": 5
+    }
+  },
+  "motd": "it's = fine\n"
+}
+`,
+		"yaml": `db:
+  "": primary
+  host: db.example.com
+  options:
+    timeout: 5
+motd: |
+  it's = fine
+`,
+		"env": `DB='primary'
+DB_HOST='db.example.com'
+DB_OPTIONS='{"timeout":5}'
+MOTD='it'\''s = fine
+'
+`,
+		"properties": `/db=primary
+/db/host=db.example.com
+/db/options={"timeout":5}
+/motd=it's = fine\n
+`,
+	}
+	for format, content := range expected {
+		ext := formatExtensions[format]
+		result, err := convertVolumeData(data, format, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != 1 {
+			t.Errorf("%s: unexpected files: %v", format, result)
+		}
+		if string(result["TREE"+ext]) != content {
+			t.Errorf("%s: invalid content:\n%s", format, result["TREE"+ext])
+		}
+	}
+
+	result, err := convertVolumeData(data, "json", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result["TREE.cdb"] == nil {
+		t.Errorf("cdb not kept: %v", result)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Volume content is published the same way kubelet publishes ConfigMap volumes.
+// Every update is written into a fresh generation directory "..gen-N",
+// the "..data" symlink pointing to the current generation is replaced by a single rename,
+// and top-level entries of the volume are symlinks into "..data".
+// So readers always see a consistent snapshot of all files and can watch for "..data" to be replaced.
+const (
+	dataLink         = "..data"
+	generationPrefix = "..gen-"
+)
+
+func generationDir(dir string, gen int) string {
+	return filepath.Join(dir, generationPrefix+strconv.Itoa(gen))
+}
+
+// listGenerations returns generations present in dir in ascending order.
+func listGenerations(dir string) ([]int, error) {
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var gens []int
+	for _, name := range names {
+		if !strings.HasPrefix(name, generationPrefix) {
+			continue
+		}
+		if gen, err := strconv.Atoi(name[len(generationPrefix):]); err == nil {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+// currentGeneration returns the generation "..data" points to or 0 if there is no one.
+func currentGeneration(dir string) (int, error) {
+	target, err := os.Readlink(filepath.Join(dir, dataLink))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if !strings.HasPrefix(target, generationPrefix) {
+		return 0, fmt.Errorf("invalid %s symlink: %q", dataLink, target)
+	}
+	return strconv.Atoi(target[len(generationPrefix):])
+}
+
+// readGeneration reads all files of the generation.
+func readGeneration(dir string, gen int) (volumeData, error) {
+	root := generationDir(dir, gen)
+	data := volumeData{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		data[name] = content
+		return nil
+	})
+	return data, err
+}
+
+// writeGeneration publishes data as a new generation in dir unless it is equal to the current one.
+// It returns the current generation and whether it was created by this call.
+func writeGeneration(dir string, data volumeData) (int, bool, error) {
+	current, err := currentGeneration(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	if current != 0 {
+		if currentData, err := readGeneration(dir, current); err == nil && currentData.equal(data) {
+			return current, false, nil
+		}
+	}
+
+	gens, err := listGenerations(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	gen := current + 1
+	if len(gens) > 0 && gens[len(gens)-1] >= gen {
+		gen = gens[len(gens)-1] + 1
+	}
+	genDir := generationDir(dir, gen)
+	if err := os.Mkdir(genDir, 0755); err != nil {
+		return 0, false, err
+	}
+	if err := writeVolumeData(genDir, data); err != nil {
+		os.RemoveAll(genDir)
+		return 0, false, err
+	}
+	if err := switchGeneration(dir, gen); err != nil {
+		return 0, false, err
+	}
+	return gen, true, nil
+}
+
+// switchGeneration atomically points "..data" to the generation and updates top-level symlinks.
+func switchGeneration(dir string, gen int) error {
+	target := filepath.Base(generationDir(dir, gen))
+	names, err := readDirNames(filepath.Join(dir, target))
+	if err != nil {
+		return err
+	}
+
+	if err := replaceSymlink(target, filepath.Join(dir, dataLink)); err != nil {
+		return err
+	}
+
+	entries := make(map[string]bool, len(names))
+	for _, name := range names {
+		entries[name] = true
+		link := filepath.Join(dir, name)
+		linkTarget := filepath.Join(dataLink, name)
+		if fi, err := os.Lstat(link); err == nil && fi.IsDir() { // left by a version writing files directly
+			if err := os.RemoveAll(link); err != nil {
+				return err
+			}
+		} else if t, err := os.Readlink(link); err == nil && t == linkTarget {
+			continue
+		}
+		if err := replaceSymlink(linkTarget, link); err != nil {
+			return err
+		}
+	}
+
+	topLevel, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range topLevel {
+		if strings.HasPrefix(name, "..") || strings.HasPrefix(name, metadataPrefix) || entries[name] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOldGenerations removes all but the last keep generations, the current one is never removed.
+func removeOldGenerations(dir string, keep int) error {
+	current, err := currentGeneration(dir)
+	if err != nil {
+		return err
+	}
+	gens, err := listGenerations(dir)
+	if err != nil {
+		return err
+	}
+	if keep < 1 {
+		keep = 1
+	}
+	for i := 0; i < len(gens)-keep; i++ {
+		if gens[i] == current {
+			continue
+		}
+		if err := os.RemoveAll(generationDir(dir, gens[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaceSymlink(target, link string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(0)
+}
+
+func (data volumeData) equal(other volumeData) bool {
+	if len(data) != len(other) {
+		return false
+	}
+	for name, content := range data {
+		if oc, ok := other[name]; !ok || !bytes.Equal(content, oc) {
+			return false
+		}
+	}
+	return true
+}
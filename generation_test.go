@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onlineconf-csi-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// left by a version writing files directly into the staging directory
+	if err := ioutil.WriteFile(filepath.Join(dir, "TREE.cdb"), []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "old.cdb"), []byte("legacy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, content := range []string{"v1", "v2", "v2", "v3", "v4"} {
+		gen, created, err := writeGeneration(dir, volumeData{"TREE.cdb": []byte(content)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := removeOldGenerations(dir, 2); err != nil {
+			t.Fatal(err)
+		}
+		if created != (i != 2) {
+			t.Errorf("%d: unexpected created: %v", i, created)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "TREE.cdb")); err != nil {
+			t.Fatal(err)
+		} else if string(data) != content {
+			t.Errorf("%d: invalid content of generation %d: %q", i, gen, data)
+		}
+	}
+
+	if current, err := currentGeneration(dir); err != nil || current != 4 {
+		t.Errorf("invalid current generation: %d, %v", current, err)
+	}
+	if gens, err := listGenerations(dir); err != nil || len(gens) != 2 || gens[0] != 3 || gens[1] != 4 {
+		t.Errorf("invalid generations: %v, %v", gens, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "old.cdb")); !os.IsNotExist(err) {
+		t.Errorf("stale file not removed: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "TREE.cdb")); err != nil || target != "..data/TREE.cdb" {
+		t.Errorf("invalid symlink: %q, %v", target, err)
+	}
+
+	if err := switchGeneration(dir, 3); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "TREE.cdb")); err != nil || string(data) != "v3" {
+		t.Errorf("invalid content after switch: %q, %v", data, err)
+	}
+}
@@ -1,12 +1,31 @@
 module github.com/onlineconf/onlineconf-csi-driver
 
-go 1.13
+go 1.23.0
 
 require (
-	github.com/container-storage-interface/spec v1.3.0
+	github.com/colinmarc/cdb v0.0.0-20190223170904-60f317823f70
+	github.com/container-storage-interface/spec v1.11.0
+	github.com/golang/protobuf v1.5.4
 	github.com/kubernetes-csi/csi-lib-utils v0.8.1
 	github.com/kubernetes-csi/csi-test/v4 v4.0.1
 	github.com/onlineconf/onlineconf/updater/v3 v3.4.0
 	github.com/rs/zerolog v1.20.0
-	google.golang.org/grpc v1.32.0
+	github.com/ugorji/go/codec v1.1.7
+	golang.org/x/net v0.40.0
+	golang.org/x/sys v0.33.0
+	google.golang.org/grpc v1.72.1
+	gopkg.in/yaml.v2 v2.2.8
+)
+
+require (
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hpcloud/tail v1.0.0 // indirect
+	github.com/onsi/ginkgo v1.11.0 // indirect
+	github.com/onsi/gomega v1.7.1 // indirect
+	golang.org/x/text v0.25.0 // indirect
+	google.golang.org/genproto v0.0.0-20250603155806-513f23925822 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250528174236-200df99c418a // indirect
+	google.golang.org/protobuf v1.36.6 // indirect
+	gopkg.in/fsnotify.v1 v1.4.7 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
 )
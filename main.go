@@ -4,30 +4,122 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	endpoint   = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
-	controller = flag.Bool("controller", false, "serve Controller Service RPC")
-	nodeId     = flag.String("node", "", "node id (serve Node Service RPC)")
-	stateFile  = flag.String("state", "/var/lib/onlineconf-csi-driver/state.json", "state file (used by Node Service only)")
+	endpoint       = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
+	controller     = flag.Bool("controller", false, "serve Controller Service RPC")
+	registry       = flag.String("registry", "", "volume registry of the controller, e.g. file:///var/lib/onlineconf-csi-driver/volumes.json, the controller is stateless if empty (used by Controller Service only)")
+	snapshotsDir   = flag.String("snapshots", "", "snapshot store shared by the controller and nodes, e.g. file:///var/lib/onlineconf-csi-driver/snapshots, snapshots are not supported if empty")
+	strict         = flag.Bool("strict", false, "reject unknown volume attributes and storage class parameters and malformed ${variable} keys")
+	minInterval    = flag.Duration("min-update-interval", 0, "minimum allowed updateInterval of volumes including the default one, same as updateInterval.min rule of -policy, not limited if 0")
+	maxInterval    = flag.Duration("max-update-interval", 0, "maximum allowed updateInterval of volumes including the default one, same as updateInterval.max rule of -policy, not limited if 0")
+	aliasesFile    = flag.String("endpoint-aliases", "", "file with onlineconf-admin endpoint aliases used by endpoint volume attribute, e.g. /etc/onlineconf-csi-driver/endpoints.yaml")
+	policyFile     = flag.String("policy", "", "policy file restricting uri, notifyURL, httpProxy, updateInterval and namespaces of secrets of volumes, e.g. /etc/onlineconf-csi-driver/policy.yaml")
+	nodeId         = flag.String("node", "", "node id (serve Node Service RPC)")
+	stateFile      = flag.String("state", "/var/lib/onlineconf-csi-driver/state.json", "state file (used by Node Service only)")
+	adminEndpoint  = flag.String("admin", "", "admin API unix socket accessible by root only, e.g. unix:///csi/admin.sock (used by Node Service only)")
+	generations    = flag.Int("generations", 3, "number of data generations kept for every volume (used by Node Service only)")
+	concurrency    = flag.Int("concurrency", 8, "number of workers performing requests to onlineconf-admin (used by Node Service only)")
+	tokenDir       = flag.String("token-dir", "", "directory containing token files which tokenFile secret key can refer to, tokenFile is not allowed if empty (used by Node Service only)")
+	secretsDir     = flag.String("secrets", "", "directory with rotated credentials of volumes in <volumeId>/<secret key> files (used by Node Service only)")
+	jitter         = flag.Float64("jitter", 0.1, "fraction of update interval by which updates are randomly delayed or advanced (used by Node Service only)")
+	httpProxy      = flag.String("http-proxy", "", "default HTTP proxy for connections to onlineconf-admin, overridden by httpProxy volume attribute (used by Node Service only)")
+	noProxy        = flag.String("no-proxy", "", "default list of hosts connected without proxy, overridden by noProxy volume attribute (used by Node Service only)")
+	requestTimeout = flag.Duration("request-timeout", 0, "default timeout of requests to onlineconf-admin, overridden by requestTimeout volume attribute (used by Node Service only)")
+	connectTimeout = flag.Duration("connect-timeout", 0, "default timeout of connecting to onlineconf-admin, overridden by connectTimeout volume attribute (used by Node Service only)")
+	restage        = flag.String("restage", "reconfigure", "what to do when a staged volume is staged again with changed attributes: reconfigure, restart or reject (used by Node Service only)")
 )
 
 func main() {
 	flag.Parse()
+	if flag.NArg() > 0 {
+		os.Exit(adminCommand(*adminEndpoint, flag.Args()))
+	}
+
+	volumeContextValidation.strict = *strict
+	if *tokenDir != "" && !filepath.IsAbs(*tokenDir) {
+		log.Fatal().Str("dir", *tokenDir).Msg("-token-dir must be an absolute path")
+	}
+	tokenFileDir = *tokenDir
+	policy := &volumePolicy{}
+	if *policyFile != "" {
+		var err error
+		if policy, err = loadVolumePolicy(*policyFile); err != nil {
+			log.Fatal().Err(err).Msg("failed to load policy")
+		}
+	}
+	if err := policy.setUpdateIntervalLimits(*minInterval, *maxInterval); err != nil {
+		log.Fatal().Err(err).Msg("invalid -min-update-interval or -max-update-interval flag")
+	}
+	if *policyFile != "" || *minInterval != 0 || *maxInterval != 0 {
+		volumeContextValidation.policy = policy
+	}
+
+	var snapshots snapshotStore
+	if *snapshotsDir != "" {
+		var err error
+		if snapshots, err = openSnapshotStore(*snapshotsDir); err != nil {
+			log.Fatal().Err(err).Msg("failed to open snapshot store")
+		}
+	}
+
+	var endpoints *endpointAliases
+	if *aliasesFile != "" {
+		var err error
+		if endpoints, err = loadEndpointAliases(*aliasesFile); err != nil {
+			log.Fatal().Err(err).Msg("failed to load endpoint aliases")
+		}
+	}
 
 	driver := newDriver()
 	if *controller {
-		driver.initControllerServer()
+		var volumes volumeRegistry
+		if *registry != "" {
+			var err error
+			if volumes, err = openVolumeRegistry(*registry); err != nil {
+				log.Fatal().Err(err).Msg("failed to open volume registry")
+			}
+		}
+		driver.initControllerServer(volumes, snapshots, endpoints)
 	}
 	if *nodeId != "" {
-		err := driver.initNodeServer(*nodeId, *stateFile)
+		policy, err := parseRestagePolicy(*restage)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid -restage flag")
+		}
+		if *httpProxy != "" {
+			if err := validateProxyURL(*httpProxy); err != nil {
+				log.Fatal().Err(err).Msg("invalid -http-proxy flag")
+			}
+		}
+		err = driver.initNodeServer(*nodeId, nodeConfig{
+			stateFile:         *stateFile,
+			generations:       *generations,
+			concurrentUpdates: *concurrency,
+			updateJitter:      *jitter,
+			secretsDir:        *secretsDir,
+			restagePolicy:     policy,
+			httpProxy:         *httpProxy,
+			noProxy:           *noProxy,
+			requestTimeout:    *requestTimeout,
+			connectTimeout:    *connectTimeout,
+			snapshots:         snapshots,
+			endpoints:         endpoints,
+		})
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to init node server")
 		}
+		if *adminEndpoint != "" {
+			if _, err := adminSocketPath(*adminEndpoint); err != nil {
+				log.Fatal().Err(err).Msg("invalid -admin flag")
+			}
+			driver.initAdminServer(*adminEndpoint)
+		}
 	}
 
 	log.Info().Msg("onlineconf-csi-driver started")
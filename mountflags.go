@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type mountFlag struct {
+	flag   uintptr
+	option string // as shown in /proc/self/mountinfo
+	group  string // flags of the same group are mutually exclusive
+}
+
+var mountFlags = map[string]mountFlag{
+	"ro":       {flag: syscall.MS_RDONLY, option: "ro"},
+	"nosuid":   {flag: syscall.MS_NOSUID, option: "nosuid"},
+	"nodev":    {flag: syscall.MS_NODEV, option: "nodev"},
+	"noexec":   {flag: syscall.MS_NOEXEC, option: "noexec"},
+	"relatime": {flag: syscall.MS_RELATIME, option: "relatime", group: "atime"},
+	"noatime":  {flag: syscall.MS_NOATIME, option: "noatime", group: "atime"},
+}
+
+func (cap *volumeCapability) parseMountFlag(flag string) error {
+	name, value := flag, ""
+	hasValue := false
+	if i := strings.IndexByte(flag, '='); i >= 0 {
+		name, value, hasValue = flag[:i], flag[i+1:], true
+	}
+
+	switch name {
+	case "mode":
+		val, err := strconv.ParseUint(value, 8, 12)
+		if err != nil {
+			return invalidMountFlag(flag, err)
+		}
+		cap.chmod = true
+		cap.mode = os.FileMode(val)
+	case "uid":
+		val, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return invalidMountFlag(flag, err)
+		}
+		cap.chown = true
+		cap.uid = int(val)
+	case "gid":
+		val, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return invalidMountFlag(flag, err)
+		}
+		cap.chown = true
+		cap.gid = int(val)
+	case "context":
+		value = strings.Trim(value, `"`)
+		if value == "" {
+			return invalidMountFlag(flag, fmt.Errorf("empty value"))
+		}
+		cap.seLinuxContext = value
+	default:
+		mf, ok := mountFlags[name]
+		if !ok {
+			return status.Error(codes.InvalidArgument, fmt.Sprintf("unsupported mount flag %q", flag))
+		}
+		if hasValue {
+			return invalidMountFlag(flag, fmt.Errorf("unexpected value"))
+		}
+		if mf.group != "" {
+			for other, omf := range mountFlags {
+				if other != name && omf.group == mf.group && cap.mountFlags&omf.flag != 0 {
+					return status.Error(codes.InvalidArgument, fmt.Sprintf("mount flag %q conflicts with %q", flag, other))
+				}
+			}
+		}
+		if cap.mountFlags&mf.flag == 0 {
+			cap.mountFlags |= mf.flag
+			cap.mountOptions = append(cap.mountOptions, mf.option)
+		}
+	}
+	return nil
+}
+
+func invalidMountFlag(flag string, err error) error {
+	return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid mount flag %q: %v", flag, err))
+}
@@ -12,6 +12,7 @@ type mountInfo struct {
 	device     string
 	root       string
 	mountPoint string
+	options    []string
 }
 
 type mountinfo []mountInfo
@@ -30,7 +31,7 @@ func parseMountInfo(r io.Reader) (mountinfo, error) {
 	s := bufio.NewScanner(r)
 	for s.Scan() {
 		fields := strings.Split(s.Text(), " ")
-		if len(fields) < 5 {
+		if len(fields) < 6 {
 			continue
 		}
 		mounts = append(mounts, mountInfo{
@@ -38,6 +39,7 @@ func parseMountInfo(r io.Reader) (mountinfo, error) {
 			device:     fields[2],
 			root:       fields[3],
 			mountPoint: fields[4],
+			options:    strings.Split(fields[5], ","),
 		})
 	}
 	return mounts, s.Err()
@@ -78,6 +80,23 @@ func (m mountInfo) getPathOnDevice(path string) string {
 	}
 }
 
+func (m mountInfo) missingOptions(options []string) []string {
+	var missing []string
+	for _, opt := range options {
+		found := false
+		for _, o := range m.options {
+			if o == opt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, opt)
+		}
+	}
+	return missing
+}
+
 func isPathWithin(path, mount string) bool {
 	return strings.HasPrefix(path, mount) &&
 		(mount == "/" || len(path) == len(mount) || path[len(mount)] == '/')
@@ -60,4 +60,11 @@ func TestGetMountSource(t *testing.T) {
 	if path != "/xxx/def" {
 		t.Errorf("invalid path: %q != %q", path, "/xxx/def")
 	}
+
+	if missing := mount.missingOptions([]string{"rw", "relatime"}); len(missing) != 0 {
+		t.Errorf("unexpected missing options: %v", missing)
+	}
+	if missing := mount.missingOptions([]string{"ro", "nosuid", "relatime"}); len(missing) != 2 || missing[0] != "ro" || missing[1] != "nosuid" {
+		t.Errorf("invalid missing options: %v", missing)
+	}
 }
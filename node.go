@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/onlineconf/onlineconf/updater/v3/updater"
@@ -14,28 +20,257 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+const defaultUpdateInterval = 10 * time.Second
+
 type updaterInfo struct {
-	updater *updater.Updater
-	wg      sync.WaitGroup
+	volumeId    string
+	state       updaterState
+	generations int
+	updater     *updater.Updater
+	routeURI    string // URI of onlineconf-admin given to the updater, see adminRouter
+	data        volumeData
+	params      volumeParams
+	status      volumeStatus
+	notifier    *notifier
+	m           sync.Mutex // protects state, updater, notifier, data, params and status
+	updating    sync.Mutex // serializes updates by the scheduler and updateNow, held without m during requests
+}
+
+func (ui *updaterInfo) update() error {
+	ui.updating.Lock()
+	defer ui.updating.Unlock()
+	ui.m.Lock()
+	frozen := ui.frozen()
+	u := ui.updater
+	ui.m.Unlock()
+	if frozen {
+		return nil
+	}
+
+	err := u.Update()
+
+	ui.m.Lock()
+	defer ui.m.Unlock()
+	err = hideRoutes(err, ui.routeURI, ui.status.URI)
+	if err == nil && !ui.frozen() { // data fetched while freezing is rendered on unfreeze
+		err = ui.render()
+	}
+	if err == updater.ErrNotModified {
+		ui.status.reportAttempt(nil)
+	} else {
+		ui.status.reportAttempt(err)
+	}
+	ui.writeStatus()
+	return err
+}
+
+// frozen reports whether new data must not be applied.
+// Frozen volumes are still updated until they get their first content.
+func (ui *updaterInfo) frozen() bool {
+	return ui.state.Frozen && ui.data != nil
+}
+
+func (ui *updaterInfo) setFrozen(frozen bool) error {
+	ui.m.Lock()
+	defer ui.m.Unlock()
+	ui.state.Frozen = frozen
+	ui.status.Frozen = frozen
+	var err error
+	if !frozen {
+		err = ui.render()
+	}
+	ui.writeStatus()
+	return err
+}
+
+// rollback publishes the generation again and freezes the volume so that it is not overwritten by the next update.
+// Zero generation means the last one preceding the current generation.
+func (ui *updaterInfo) rollback(gen int) (int, error) {
+	ui.m.Lock()
+	defer ui.m.Unlock()
+
+	current, err := currentGeneration(ui.state.DataDir)
+	if err != nil {
+		return 0, err
+	}
+	gens, err := listGenerations(ui.state.DataDir)
+	if err != nil {
+		return 0, err
+	}
+	if gen == 0 {
+		for _, g := range gens {
+			if g < current {
+				gen = g
+			}
+		}
+	}
+	found := false
+	for _, g := range gens {
+		found = found || g == gen
+	}
+	if gen == 0 || !found {
+		return 0, errGenerationNotFound
+	}
+	data, err := readGeneration(ui.state.DataDir, gen)
+	if err != nil {
+		return 0, err
+	}
+	if err := switchGeneration(ui.state.DataDir, gen); err != nil {
+		return 0, err
+	}
+	if err := setTreeAttributes(ui.state.DataDir, ui.state); err != nil {
+		log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to set data attributes")
+	}
+	log.Info().Str("volume_id", ui.volumeId).Int("generation", gen).Int("previous_generation", current).Msg("data generation rolled back")
+	if ui.notifier != nil && ui.data != nil {
+		ui.notifier.notify(ui.volumeId, gen, changedModules(ui.data, data))
+	}
+	ui.data = data
+	ui.state.Frozen = true
+	ui.status.Frozen = true
+	ui.status.Generation = gen
+	ui.status.Hash = data.hash()
+	ui.writeStatus()
+	return gen, nil
+}
+
+func (ui *updaterInfo) getStatus() volumeStatus {
+	ui.m.Lock()
+	defer ui.m.Unlock()
+	return ui.status
+}
+
+func (ui *updaterInfo) writeStatus() {
+	if err := ui.status.write(ui.state.DataDir, ui.state); err != nil {
+		log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to write status")
+	}
+}
+
+// render publishes the updater output from the working directory into the staging directory.
+// It must be called with ui.m held.
+func (ui *updaterInfo) render() error {
+	data, err := readVolumeData(ui.state)
+	if err == errDataNotFound {
+		// the current generation is kept, a module renamed or temporarily missing in onlineconf-admin must not wipe it
+		log.Warn().Str("volume_id", ui.volumeId).Str("module", ui.state.Module).Str("path", ui.state.Path).Msg("requested data not found")
+		return err
+	} else if err != nil {
+		log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to read data")
+		return err
+	}
+	params, err := readVolumeParams(data)
+	if err != nil {
+		log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to read parameters")
+		return err
+	}
+	data, err = convertVolumeData(data, ui.state.Format, ui.state.KeepCDB)
+	if err != nil {
+		log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to convert data")
+		return err
+	}
+	gen, created, err := writeGeneration(ui.state.DataDir, data)
+	if err != nil {
+		log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to write data")
+		return err
+	}
+	ui.status.Generation = gen
+	ui.status.Hash = data.hash()
+	if created {
+		log.Info().Str("volume_id", ui.volumeId).Int("generation", gen).Msg("data generation switched")
+		if err := removeOldGenerations(ui.state.DataDir, ui.generations); err != nil {
+			log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to remove old generations")
+		}
+		if ui.notifier != nil && ui.data != nil {
+			ui.notifier.notify(ui.volumeId, gen, changedModules(ui.data, data))
+		}
+	}
+	ui.data = data
+	if ui.params != nil {
+		if record := diffParams(ui.params, params); record != nil {
+			record.Time = time.Now().UTC()
+			record.Generation = gen
+			logAuditRecord(ui.volumeId, record)
+			if ui.state.AuditHistory > 0 {
+				if err := appendAuditRecord(ui.state.DataDir, record, ui.state.AuditHistory, ui.state); err != nil {
+					log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to write audit file")
+				}
+			}
+		}
+	}
+	ui.params = params
+	if err := setTreeAttributes(ui.state.DataDir, ui.state); err != nil {
+		log.Error().Err(err).Str("volume_id", ui.volumeId).Msg("failed to set data attributes")
+		return err
+	}
+	return nil
+}
+
+type nodeConfig struct {
+	stateFile         string
+	generations       int
+	concurrentUpdates int     // number of workers performing requests to onlineconf-admin
+	updateJitter      float64 // fraction of update interval by which updates are randomly delayed or advanced
+	secretsDir        string  // directory with credentials of volumes to rotate, see watchSecrets
+	restagePolicy     restagePolicy
+	// node-wide defaults of connection settings of volumes
+	httpProxy      string
+	noProxy        string
+	requestTimeout time.Duration
+	connectTimeout time.Duration
+	snapshots      snapshotStore    // nil if snapshots are not supported
+	endpoints      *endpointAliases // nil if endpoint aliases are not configured
+}
+
+// withDefaults returns the state with its endpoint alias resolved and connection settings not set by the volume
+// or the alias replaced by node-wide defaults.
+// Neither is persisted, so changed aliases and flags are applied to restored volumes.
+func (config nodeConfig) withDefaults(state updaterState) updaterState {
+	state = config.endpoints.resolve(state)
+	if state.HTTPProxy == "" {
+		state.HTTPProxy = config.httpProxy
+	}
+	if state.NoProxy == "" {
+		state.NoProxy = config.noProxy
+	}
+	if state.RequestTimeout == 0 {
+		state.RequestTimeout = config.requestTimeout
+	}
+	if state.ConnectTimeout == 0 {
+		state.ConnectTimeout = config.connectTimeout
+	}
+	return state
 }
 
 type nodeServer struct {
 	csi.UnimplementedNodeServer
-	id       string
-	m        sync.Mutex
-	state    *state
-	updaters map[string]*updaterInfo
+	id        string
+	config    nodeConfig
+	workDir   string
+	m         sync.Mutex
+	state     *state
+	updaters  map[string]*updaterInfo
+	busy      map[string]string // staging paths of volumes waiting for an update or its end without ns.m, by volume id
+	scheduler *scheduler
+	router    *adminRouter
+	done      chan struct{}
+	wg        sync.WaitGroup
 }
 
-func newNodeServer(id string, stateFile string) (*nodeServer, error) {
-	state, err := readState(stateFile)
+func newNodeServer(id string, config nodeConfig) (*nodeServer, error) {
+	state, err := readState(config.stateFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open state file: %w", err)
 	}
 	return &nodeServer{
-		id:       id,
-		state:    state,
-		updaters: make(map[string]*updaterInfo),
+		id:        id,
+		config:    config,
+		workDir:   filepath.Join(filepath.Dir(config.stateFile), "volumes"),
+		state:     state,
+		updaters:  make(map[string]*updaterInfo),
+		busy:      make(map[string]string),
+		scheduler: newScheduler(config.concurrentUpdates, config.updateJitter),
+		router:    installAdminRouter(config.concurrentUpdates),
+		done:      make(chan struct{}),
 	}, nil
 }
 
@@ -53,6 +288,13 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -76,12 +318,62 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if err != nil {
 		return nil, err
 	}
+	if volCtx.endpoint != "" {
+		if _, ok := ns.config.endpoints.get(volCtx.endpoint); !ok {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown endpoint %q", volCtx.endpoint))
+		}
+	}
+	secretNamespace := req.GetSecrets()[secretNamespaceKey]
+	if policy := volumeContextValidation.policy; policy != nil && len(req.GetSecrets()) > 0 {
+		// the namespace of the volume isn't known yet, rules of namespaces are checked by NodePublishVolume
+		if err := policy.checkSecret("", secretNamespace); err != nil {
+			return nil, err
+		}
+	}
 
 	ns.m.Lock()
 	defer ns.m.Unlock()
+	if err := ns.checkBusy(volumeId, stage); err != nil {
+		return nil, err
+	}
 
+	creds := readCredentials(req.GetSecrets())
 	if us, ok := ns.state.Updaters[volumeId]; ok {
 		if us.DataDir == stage {
+			// kubelet doesn't restage volumes, but a repeated call is a way to rotate credentials or to change attributes
+			state := newUpdaterState(us.DataDir, us.WorkDir, volCtx, volCap, creds)
+			state.SecretNamespace = secretNamespace
+			if err := ns.bindSnapshot(&state); err != nil {
+				return nil, updateError(state, err)
+			}
+			state.Frozen = us.Frozen
+			if changes := contextChanges(us, state); len(changes) > 0 {
+				if err := validateUpdaterState(state); err != nil {
+					return nil, err
+				}
+				if err := ns.restage(volumeId, us, state, changes); err != nil {
+					return nil, err
+				}
+			} else {
+				if _, err := ns.setCredentialsLocked(volumeId, creds); errors.Is(err, errInvalidCredentials) {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				} else if err != nil {
+					log.Error().Err(err).Str("volume_id", volumeId).Msg("failed to update credentials")
+					return nil, status.Error(codes.Internal, err.Error())
+				}
+				if us := ns.state.Updaters[volumeId]; us.SecretNamespace != secretNamespace {
+					us.SecretNamespace = secretNamespace
+					ns.state.Updaters[volumeId] = us
+					ns.state.save()
+				}
+			}
+			// mode= applies to the volume root directory only, so a changed mode is applied in place
+			if volCap.chmod {
+				if err := os.Chmod(stage, volCap.mode); err != nil {
+					log.Error().Err(err).Msg("failed to chmod StagingTargetPath")
+					return nil, status.Error(codes.Internal, "failed to chmod StagingTargetPath")
+				}
+			}
 			return &csi.NodeStageVolumeResponse{}, nil
 		} else {
 			return nil, status.Error(codes.InvalidArgument, "volume is already staged to another StagingTargetPath")
@@ -104,17 +396,18 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		}
 	}
 
-	state := updaterState{
-		DataDir:        stage,
-		URI:            volCtx.uri,
-		Username:       req.GetSecrets()["username"],
-		Password:       req.GetSecrets()["password"],
-		UpdateInterval: volCtx.updateInterval,
-		Variables:      volCtx.vars,
+	state := newUpdaterState(stage, ns.volumeWorkDir(volumeId), volCtx, volCap, creds)
+	state.SecretNamespace = secretNamespace
+	if err := validateUpdaterState(state); err != nil {
+		return nil, err
+	}
+	if err := ns.bindSnapshot(&state); err != nil {
+		return nil, updateError(state, err)
 	}
 	if err := ns.runUpdater(volumeId, state, false); err != nil {
 		log.Error().Err(err).Msg("failed to run updater")
-		return nil, status.Error(codes.Internal, err.Error())
+		os.RemoveAll(state.WorkDir)
+		return nil, updateError(state, err)
 	}
 	ns.state.Updaters[volumeId] = state
 	ns.state.save()
@@ -122,6 +415,86 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+func newUpdaterState(stage, workDir string, volCtx *volumeContext, volCap *volumeCapability, creds adminCredentials) updaterState {
+	state := updaterState{
+		DataDir:        stage,
+		WorkDir:        workDir,
+		Module:         volCtx.module,
+		Path:           volCtx.path,
+		Format:         volCtx.format,
+		KeepCDB:        volCtx.keepCDB,
+		NotifyURL:      volCtx.notifyURL,
+		AuditHistory:   volCtx.auditHistory,
+		URI:            volCtx.uri,
+		Endpoint:       volCtx.endpoint,
+		TokenAudience:  volCtx.tokenAudience,
+		TLSMinVersion:  volCtx.tlsMinVersion,
+		TLSServerName:  volCtx.tlsServerName,
+		HTTPProxy:      volCtx.httpProxy,
+		NoProxy:        volCtx.noProxy,
+		RequestTimeout: volCtx.requestTimeout,
+		ConnectTimeout: volCtx.connectTimeout,
+		UpdateInterval: volCtx.updateInterval,
+		Snapshot:       volCtx.snapshot,
+		Variables:      volCtx.vars,
+		Frozen:         volCtx.frozen,
+		Chown:          volCap.chown,
+		UID:            volCap.uid,
+		GID:            volCap.gid,
+		SELinuxContext: volCap.seLinuxContext,
+	}
+	state.setCredentials(creds)
+	return state
+}
+
+// bindSnapshot sets the namespace of the snapshot the volume is staged from.
+// The volume context is written by the author of the PV, so the namespace is taken from the snapshot store
+// and checked against the namespace of the pod by NodePublishVolume.
+func (ns *nodeServer) bindSnapshot(state *updaterState) error {
+	if state.Snapshot == "" {
+		return nil
+	}
+	namespace, err := ns.snapshotNamespace(state.Snapshot)
+	if err != nil {
+		return err
+	}
+	state.SnapshotNamespace = namespace
+	return nil
+}
+
+// validateUpdaterState checks credentials and connection settings of the volume being staged.
+func validateUpdaterState(state updaterState) error {
+	if err := state.credentials().validate(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if state.TokenAudience != "" && (state.Token != "" || state.TokenFile != "") {
+		return status.Error(codes.InvalidArgument, "serviceAccountTokenAudience is mutually exclusive with token and tokenFile")
+	}
+	if state.TokenFile != "" {
+		if _, err := checkTokenFile(state.TokenFile); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if _, err := state.transportSettings().tlsConfig(); err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid TLS settings: %v", err))
+	}
+	return nil
+}
+
+// updateError converts an error of the first update of the volume to gRPC status.
+func updateError(state updaterState, err error) error {
+	if err == errSnapshotsNotSupported || err == errSnapshotNotFound {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("snapshot %q: %v", state.Snapshot, err))
+	}
+	if err == errDataNotFound {
+		if state.Module != "" {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("module %q not found in configuration", state.Module))
+		}
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("path %q not found in configuration", state.Path))
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	volumeId := req.GetVolumeId()
 	stage := req.GetStagingTargetPath()
@@ -135,21 +508,28 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 
 	ns.m.Lock()
 	defer ns.m.Unlock()
+	if err := ns.checkBusy(volumeId, stage); err != nil {
+		return nil, err
+	}
 
-	if us, ok := ns.state.Updaters[volumeId]; !(ok && us.DataDir == stage) {
+	us, ok := ns.state.Updaters[volumeId]
+	if !(ok && us.DataDir == stage) {
 		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
 
 	if ui := ns.updaters[stage]; ui != nil {
 		log.Info().Str("volume_id", volumeId).Msg("stopping updater")
-		ui.updater.Stop()
-		ui.wg.Wait()
+		ns.stopUpdater(ui)
 	}
 
 	if err := os.RemoveAll(stage); err != nil {
 		log.Error().Err(err).Msg("failed to remove StagingTargetDir")
 		return nil, status.Error(codes.Internal, "failed to remove StagingTargetPath")
 	}
+	if err := os.RemoveAll(us.WorkDir); err != nil {
+		log.Error().Err(err).Msg("failed to remove working directory")
+		return nil, status.Error(codes.Internal, "failed to remove working directory")
+	}
 	delete(ns.state.Updaters, volumeId)
 	ns.state.save()
 
@@ -167,30 +547,82 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if target == "" {
 		return nil, status.Error(codes.InvalidArgument, "TargetPath missing in request")
 	}
-	if req.GetVolumeCapability() == nil {
-		return nil, status.Error(codes.InvalidArgument, "VolumeCapability missing in request")
+	volCap, err := readVolumeCapability(req.GetVolumeCapability())
+	if err != nil {
+		return nil, err
 	}
 	if stage == "" {
 		return nil, status.Error(codes.FailedPrecondition, "StagingTargetPath missing in request")
 	}
+	mountOptions := append([]string{"ro"}, volCap.mountOptions...)
 
 	ns.m.Lock()
 	defer ns.m.Unlock()
+	if err := ns.checkBusy(volumeId, ""); err != nil {
+		return nil, err
+	}
 
-	if us, ok := ns.state.Updaters[volumeId]; !ok {
+	us, ok := ns.state.Updaters[volumeId]
+	if !ok {
 		return nil, status.Error(codes.NotFound, "unknown VolumeId")
 	} else if us.DataDir != stage {
 		return nil, status.Error(codes.InvalidArgument, "incompatible VolumeId and StagingTargetPath")
 	}
+	if volCap.mountGroup && (!us.Chown || us.GID != volCap.gid) {
+		// files are shared by all pods the volume is published to, so they have the group of the first one
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume is staged for another group, it can't be published with volume_mount_group %d", volCap.gid))
+	}
+
+	policy := volumeContextValidation.policy
+	if us.Snapshot != "" || policy != nil && len(policy.Namespaces) > 0 {
+		podNamespace := req.GetVolumeContext()[podNamespaceKey]
+		if podNamespace == "" {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s missing in volume context, podInfoOnMount must be enabled in CSIDriver", podNamespaceKey))
+		}
+		if us.Snapshot != "" && (us.SnapshotNamespace == "" || podNamespace != us.SnapshotNamespace) {
+			return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("snapshot %q doesn't belong to namespace %q", us.Snapshot, podNamespace))
+		}
+		if policy != nil {
+			if err := policy.checkNamespace(podNamespace, us.policyContext()); err != nil {
+				return nil, err
+			}
+			if us.credentials() != (adminCredentials{}) {
+				if err := policy.checkSecret(podNamespace, us.SecretNamespace); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if us.TokenAudience != "" {
+		// called again by kubelet with a fresh token before the previous one expires (requiresRepublish)
+		token, err := readServiceAccountToken(req.GetVolumeContext(), us.TokenAudience)
+		if err != nil {
+			return nil, err
+		}
+		if ui := ns.updaters[stage]; ui != nil {
+			if err := ns.router.setPodToken(ui.routeURI, target, token); err != nil {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			if ui.getStatus().Generation == 0 { // the volume has not been updated without a token at stage
+				if err := ns.unlocked(volumeId, stage, func() error { return ns.scheduler.updateNow(ui) }); err != nil {
+					log.Error().Err(err).Str("volume_id", volumeId).Msg("update failed")
+					return nil, updateError(us, err)
+				}
+			}
+		}
+	}
 
 	if mounts, err := readMountInfo(); err != nil {
 		log.Error().Err(err).Msg("failed to read mountinfo")
 		return nil, status.Error(codes.Internal, "failed to read mountinfo")
 	} else if mount := mounts.getByMountPoint(target); mount != nil {
-		if mounts.verifyMountSource(mount, stage) {
-			return &csi.NodePublishVolumeResponse{}, nil
-		} else {
+		if !mounts.verifyMountSource(mount, stage) {
 			return nil, status.Error(codes.InvalidArgument, "incompatible StagingTargetPath")
+		} else if missing := mount.missingOptions(mountOptions); len(missing) != 0 {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("volume is already published to TargetPath without mount flags %v", missing))
+		} else {
+			return &csi.NodePublishVolumeResponse{}, nil
 		}
 	}
 
@@ -204,11 +636,24 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.Internal, "failed to mount")
 	}
 
-	if err := syscall.Mount(stage, target, "", syscall.MS_MGC_VAL|syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+	if err := syscall.Mount(stage, target, "", syscall.MS_MGC_VAL|syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|volCap.mountFlags, ""); err != nil {
 		log.Error().Err(err).Msg("failed to remount")
 		return nil, status.Error(codes.Internal, "failed to remount")
 	}
 
+	if mounts, err := readMountInfo(); err != nil {
+		log.Error().Err(err).Msg("failed to read mountinfo")
+		return nil, status.Error(codes.Internal, "failed to read mountinfo")
+	} else if mount := mounts.getByMountPoint(target); mount == nil {
+		return nil, status.Error(codes.Internal, "mount not found in mountinfo")
+	} else if missing := mount.missingOptions(mountOptions); len(missing) != 0 {
+		log.Error().Strs("options", missing).Str("target", target).Msg("mount flags not applied")
+		if err := syscall.Unmount(target, 0); err != nil {
+			log.Error().Err(err).Msg("failed to unmount")
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("mount flags %v not applied", missing))
+	}
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -225,6 +670,15 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 
 	ns.m.Lock()
 	defer ns.m.Unlock()
+	if err := ns.checkBusy(volumeId, ""); err != nil {
+		return nil, err
+	}
+
+	if us, ok := ns.state.Updaters[volumeId]; ok && us.TokenAudience != "" {
+		if ui := ns.updaters[us.DataDir]; ui != nil {
+			ns.router.removePodToken(ui.routeURI, target)
+		}
+	}
 
 	if err := syscall.Unmount(target, 0); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
 		log.Error().Err(err).Msg("failed to unmount")
@@ -242,37 +696,106 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 func (ns *nodeServer) runUpdater(volumeId string, state updaterState, restore bool) error {
 	log.Info().Str("volume_id", volumeId).Dur("updateInterval", state.UpdateInterval).Msg("starting updater")
 
-	u := updater.NewUpdater(updater.UpdaterConfig{
-		Admin: updater.AdminConfig{
-			URI:      state.URI,
-			Username: state.Username,
-			Password: state.Password,
-		},
-		UpdateInterval: state.UpdateInterval,
-		DataDir:        state.DataDir,
-		Variables:      state.Variables,
-	})
-	if err := u.Update(); err != nil {
-		if !restore {
+	if err := os.MkdirAll(state.WorkDir, 0700); err != nil {
+		return err
+	}
+
+	resolved := ns.config.withDefaults(state)
+	routeURI, err := ns.router.add(resolved)
+	if err != nil {
+		return err
+	}
+	ui := &updaterInfo{
+		volumeId:    volumeId,
+		state:       state,
+		generations: ns.config.generations,
+		updater:     newUpdater(routeURI, state),
+		routeURI:    routeURI,
+		status:      newVolumeStatus(resolved),
+	}
+	if gen, err := currentGeneration(state.DataDir); err == nil && gen != 0 {
+		ui.status.Generation = gen
+		if data, err := readGeneration(state.DataDir, gen); err == nil {
+			ui.data = data
+			ui.status.Hash = data.hash()
+		}
+	}
+	if data, err := readVolumeData(state); err == nil && len(data) != 0 {
+		ui.params, _ = readVolumeParams(data) // updater output of the previous run
+	}
+	if state.Snapshot != "" && ui.data == nil {
+		// the content of the snapshot is served to the updater by the router instead of onlineconf-admin
+		data, err := ns.snapshotData(state.Snapshot)
+		if err != nil {
+			ns.router.remove(routeURI)
 			return err
 		}
-		log.Error().Err(err).Str("volume_id", volumeId).Msg("update failed")
+		ns.router.setSnapshot(routeURI, data)
+	}
+	if state.NotifyURL != "" {
+		ui.notifier = newNotifier(state.NotifyURL)
+	}
+	interval := state.UpdateInterval
+	if interval == 0 {
+		interval = defaultUpdateInterval
+	}
+	firstDelay := ns.scheduler.delay(interval)
+	switch {
+	case state.Snapshot != "" && ui.data != nil:
+		// the volume already has the content of the snapshot
+	case restore && ui.data != nil:
+		// the volume already has content, so its update is spread over the update interval
+		// instead of hitting onlineconf-admin simultaneously with all other restored volumes
+		firstDelay = ns.scheduler.phase(interval)
+	case state.TokenAudience != "":
+		// there is no token until the volume is published to a pod, so the first update is performed by NodePublishVolume
+	default:
+		if err := ns.unlocked(volumeId, state.DataDir, func() error { return ns.scheduler.updateNow(ui) }); err != nil {
+			if !restore {
+				if ui.notifier != nil {
+					ui.notifier.stop()
+				}
+				ns.router.remove(routeURI)
+				return err
+			}
+			log.Error().Err(err).Str("volume_id", volumeId).Msg("update failed")
+		}
 	}
 
-	ui := &updaterInfo{updater: u}
-	ui.wg.Add(1)
 	ns.updaters[state.DataDir] = ui
+	if state.Snapshot == "" {
+		ns.scheduler.add(ui, interval, firstDelay)
+	}
 	log.Info().Str("volume_id", volumeId).Msg("updater started")
-	go func() {
-		u.Run()
-		log.Info().Str("volume_id", volumeId).Msg("updater stopped")
-		delete(ns.updaters, state.DataDir)
-		ui.wg.Done()
-	}()
-
 	return nil
 }
 
+// stopUpdater stops updates of the volume and waits for the running one to finish.
+// It must be called with ns.m held, which is released while waiting.
+func (ns *nodeServer) stopUpdater(ui *updaterInfo) {
+	ns.unlocked(ui.volumeId, ui.state.DataDir, func() error {
+		ns.scheduler.remove(ui)
+		return nil
+	})
+	if ui.notifier != nil {
+		ui.notifier.stop()
+	}
+	ns.router.remove(ui.routeURI)
+	delete(ns.updaters, ui.state.DataDir)
+	log.Info().Str("volume_id", ui.volumeId).Msg("updater stopped")
+}
+
+func newUpdater(routeURI string, state updaterState) *updater.Updater {
+	return updater.NewUpdater(updater.UpdaterConfig{
+		Admin: updater.AdminConfig{
+			URI: routeURI, // credentials are set by the router
+		},
+		UpdateInterval: state.UpdateInterval,
+		DataDir:        state.WorkDir,
+		Variables:      state.Variables,
+	})
+}
+
 func (ns *nodeServer) start() {
 	ns.m.Lock()
 	defer ns.m.Unlock()
@@ -283,18 +806,181 @@ func (ns *nodeServer) start() {
 			continue
 		}
 
+		if state.WorkDir == "" { // staged by a version writing directly into StagingTargetPath
+			state.WorkDir = ns.volumeWorkDir(volumeId)
+			ns.state.Updaters[volumeId] = state
+			ns.state.save()
+		}
 		ns.runUpdater(volumeId, state, true)
 	}
+
+	if ns.config.secretsDir != "" {
+		ns.wg.Add(1)
+		go ns.watchSecrets()
+	}
+	if ns.config.endpoints != nil {
+		ns.wg.Add(1)
+		go ns.watchEndpointAliases()
+	}
 }
 
 func (ns *nodeServer) stop() {
+	close(ns.done)
+	ns.wg.Wait()
+
 	ns.m.Lock()
 	defer ns.m.Unlock()
 
+	ns.scheduler.stop()
 	for _, ui := range ns.updaters {
-		ui.updater.Stop()
+		ns.stopUpdater(ui)
 	}
+}
+
+func (ns *nodeServer) volumeWorkDir(volumeId string) string {
+	name := url.PathEscape(volumeId)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return filepath.Join(ns.workDir, name)
+}
+
+var (
+	errVolumeNotFound     = errors.New("volume not found")
+	errGenerationNotFound = errors.New("generation not found")
+	errVolumeBusy         = errors.New("an operation for the volume is in progress")
+)
+
+// unlocked performs a blocking wait of an operation for the volume (an update or its end) without ns.m,
+// so that a hung onlineconf-admin or a busy worker pool doesn't block operations for other volumes.
+// Meanwhile the volume is marked busy and other operations for it fail. It must be called with ns.m held.
+func (ns *nodeServer) unlocked(volumeId, stage string, wait func() error) error {
+	ns.busy[volumeId] = stage
+	ns.m.Unlock()
+	defer func() {
+		ns.m.Lock()
+		delete(ns.busy, volumeId)
+	}()
+	return wait()
+}
+
+// checkBusy returns Aborted if an operation for the volume or another volume with the same staging path is in progress.
+// It must be called with ns.m held.
+func (ns *nodeServer) checkBusy(volumeId, stage string) error {
+	for id, path := range ns.busy {
+		if id == volumeId || stage != "" && path == stage {
+			return status.Error(codes.Aborted, errVolumeBusy.Error())
+		}
+	}
+	return nil
+}
+
+// freezeVolume stops or resumes applying new data to the staged volume.
+func (ns *nodeServer) freezeVolume(volumeId string, frozen bool) error {
+	ns.m.Lock()
+	defer ns.m.Unlock()
+	if _, ok := ns.busy[volumeId]; ok {
+		return errVolumeBusy
+	}
+
+	us, ok := ns.state.Updaters[volumeId]
+	if !ok {
+		return errVolumeNotFound
+	}
+	us.Frozen = frozen
+	ns.state.Updaters[volumeId] = us
+	if err := ns.state.save(); err != nil {
+		return err
+	}
+	log.Info().Str("volume_id", volumeId).Bool("frozen", frozen).Msg("volume freeze state changed")
+
+	if ui := ns.updaters[us.DataDir]; ui != nil {
+		return ui.setFrozen(frozen)
+	}
+	return nil
+}
+
+// rollbackVolume switches the volume back to a kept generation and freezes it until it is unfrozen.
+func (ns *nodeServer) rollbackVolume(volumeId string, gen int) (int, error) {
+	ns.m.Lock()
+	defer ns.m.Unlock()
+	if _, ok := ns.busy[volumeId]; ok {
+		return 0, errVolumeBusy
+	}
+
+	us, ok := ns.state.Updaters[volumeId]
+	if !ok {
+		return 0, errVolumeNotFound
+	}
+	ui := ns.updaters[us.DataDir]
+	if ui == nil {
+		return 0, errVolumeNotFound
+	}
+	gen, err := ui.rollback(gen)
+	if err != nil {
+		return 0, err
+	}
+	if !us.Frozen {
+		us.Frozen = true
+		ns.state.Updaters[volumeId] = us
+		if err := ns.state.save(); err != nil {
+			return gen, err
+		}
+	}
+	return gen, nil
+}
+
+type generationInfo struct {
+	Generation int    `json:"generation"`
+	Current    bool   `json:"current"`
+	Hash       string `json:"hash"`
+}
+
+// volumeGenerations lists generations kept for the volume.
+func (ns *nodeServer) volumeGenerations(volumeId string) ([]generationInfo, error) {
+	ns.m.Lock()
+	us, ok := ns.state.Updaters[volumeId]
+	ns.m.Unlock()
+	if !ok {
+		return nil, errVolumeNotFound
+	}
+
+	current, err := currentGeneration(us.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	gens, err := listGenerations(us.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]generationInfo, 0, len(gens))
+	for _, gen := range gens {
+		data, err := readGeneration(us.DataDir, gen)
+		if os.IsNotExist(err) { // removed concurrently by the updater
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, generationInfo{Generation: gen, Current: gen == current, Hash: data.hash()})
+	}
+	return infos, nil
+}
+
+type volumeInfo struct {
+	VolumeID string `json:"volumeId"`
+	volumeStatus
+}
+
+func (ns *nodeServer) volumeInfos() []volumeInfo {
+	ns.m.Lock()
+	defer ns.m.Unlock()
+
+	infos := make([]volumeInfo, 0, len(ns.updaters))
 	for _, ui := range ns.updaters {
-		ui.wg.Wait()
+		infos = append(infos, volumeInfo{VolumeID: ui.volumeId, volumeStatus: ui.getStatus()})
 	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].VolumeID < infos[j].VolumeID
+	})
+	return infos
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeMountGroup(t *testing.T) {
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	ns, dir := testNodeServer(t)
+	defer os.RemoveAll(dir)
+	defer ns.stop()
+	ctx := context.Background()
+
+	caps, err := ns.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertised := false
+	for _, c := range caps.GetCapabilities() {
+		if c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP {
+			advertised = true
+		}
+	}
+	if !advertised {
+		t.Error("VOLUME_MOUNT_GROUP is not advertised")
+	}
+
+	volCap := func(group string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{VolumeMountGroup: group}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+		}
+	}
+	stage := filepath.Join(dir, "stage")
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: stage,
+		VolumeCapability:  volCap("2000"),
+		VolumeContext:     map[string]string{"uri": admin.URL, "module": "TREE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "TREE.cdb"} {
+		if info, err := os.Stat(filepath.Join(stage, name)); err != nil {
+			t.Error(err)
+		} else if gid := info.Sys().(*syscall.Stat_t).Gid; gid != 2000 {
+			t.Errorf("%s: volume_mount_group is not applied: gid %d", name, gid)
+		}
+	}
+
+	_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: stage,
+		TargetPath:        filepath.Join(dir, "target"),
+		VolumeCapability:  volCap("3000"),
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("publishing with another volume_mount_group: unexpected error: %v", err)
+	}
+}
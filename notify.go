@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// notifyTransport is a copy of the original http.DefaultTransport made before it is replaced by adminRouter,
+// so notifications never pass through routes of volumes and never carry their credentials.
+var notifyTransport http.RoundTripper = http.DefaultTransport.(*http.Transport).Clone()
+
+type notification struct {
+	VolumeID   string   `json:"volumeId"`
+	Generation int      `json:"generation"`
+	Modules    []string `json:"modules"`
+}
+
+// notifier delivers notifications about volume content changes to a webhook.
+// Notifications are delivered asynchronously, retried with exponential backoff
+// and merged together if a new one arrives before the previous one is delivered.
+type notifier struct {
+	url         string
+	client      *http.Client
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+
+	m       sync.Mutex
+	pending *notification
+	signal  chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newNotifier(url string) *notifier {
+	n := &notifier{
+		url: url,
+		client: &http.Client{
+			Transport: notifyTransport,
+			Timeout:   10 * time.Second,
+			// notifyURL is checked by the policy, redirects could lead anywhere
+			CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		backoff:     time.Second,
+		maxBackoff:  time.Minute,
+		maxAttempts: 8,
+		signal:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	n.wg.Add(1)
+	go n.run()
+	return n
+}
+
+func (n *notifier) notify(volumeId string, generation int, modules []string) {
+	n.m.Lock()
+	if n.pending == nil {
+		n.pending = &notification{VolumeID: volumeId}
+	}
+	n.pending.Generation = generation
+	n.pending.Modules = mergeModules(n.pending.Modules, modules)
+	n.m.Unlock()
+
+	select {
+	case n.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (n *notifier) stop() {
+	close(n.done)
+	n.wg.Wait()
+}
+
+func (n *notifier) run() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.signal:
+		}
+
+		n.m.Lock()
+		msg := n.pending
+		n.pending = nil
+		n.m.Unlock()
+		if msg == nil {
+			continue
+		}
+
+		backoff := n.backoff
+		for attempt := 1; ; attempt++ {
+			retry, err := n.deliver(msg)
+			if err == nil {
+				log.Info().Str("volume_id", msg.VolumeID).Int("generation", msg.Generation).Msg("change notification delivered")
+				break
+			}
+			if !retry || attempt >= n.maxAttempts {
+				log.Error().Err(err).Str("volume_id", msg.VolumeID).Int("generation", msg.Generation).Int("attempts", attempt).Msg("failed to deliver change notification")
+				break
+			}
+			log.Warn().Err(err).Str("volume_id", msg.VolumeID).Dur("backoff", backoff).Msg("failed to deliver change notification, retrying")
+			select {
+			case <-n.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > n.maxBackoff {
+				backoff = n.maxBackoff
+			}
+
+			// a newer notification supersedes the one being retried
+			n.m.Lock()
+			if n.pending != nil {
+				n.pending.Modules = mergeModules(n.pending.Modules, msg.Modules)
+				msg = n.pending
+				n.pending = nil
+			}
+			n.m.Unlock()
+		}
+	}
+}
+
+func (n *notifier) deliver(msg *notification) (retry bool, err error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "onlineconf-csi-driver/"+version)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// changedModules returns names of modules whose files differ between old and new data.
+func changedModules(old, new volumeData) []string {
+	changed := make(map[string]bool)
+	for name, content := range new {
+		if oc, ok := old[name]; !ok || !bytes.Equal(oc, content) {
+			changed[moduleName(name)] = true
+		}
+	}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			changed[moduleName(name)] = true
+		}
+	}
+	modules := make([]string, 0, len(changed))
+	for m := range changed {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+func moduleName(file string) string {
+	file = filepath.Base(file)
+	return strings.TrimSuffix(file, filepath.Ext(file))
+}
+
+func mergeModules(a, b []string) []string {
+	set := make(map[string]bool, len(a)+len(b))
+	for _, m := range a {
+		set[m] = true
+	}
+	for _, m := range b {
+		set[m] = true
+	}
+	modules := make([]string, 0, len(set))
+	for m := range set {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+	return modules
+}
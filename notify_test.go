@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNotifier(t *testing.T) {
+	var m sync.Mutex
+	var requests int
+	received := make(chan notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		requests++
+		n := requests
+		m.Unlock()
+		if n <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var msg notification
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Error(err)
+		}
+		received <- msg
+	}))
+	defer server.Close()
+
+	n := newNotifier(server.URL)
+	if n.client.Transport != notifyTransport {
+		t.Error("notifier doesn't use its own transport")
+	}
+	n.backoff = 10 * time.Millisecond
+	defer n.stop()
+
+	n.notify("vol-1", 2, []string{"TREE"})
+	n.notify("vol-1", 3, []string{"my-service"})
+
+	select {
+	case msg := <-received:
+		expected := notification{VolumeID: "vol-1", Generation: 3, Modules: []string{"TREE", "my-service"}}
+		if !reflect.DeepEqual(msg, expected) {
+			t.Errorf("invalid notification: %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not delivered")
+	}
+}
+
+func TestNotifierRedirect(t *testing.T) {
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	n := newNotifier(server.URL)
+	defer n.stop()
+	if retry, err := n.deliver(&notification{VolumeID: "vol-1", Generation: 1}); err == nil || retry {
+		t.Errorf("redirect: unexpected result: %v, %v", retry, err)
+	}
+	if redirected {
+		t.Error("notification followed the redirect")
+	}
+}
+
+func TestNotifyURLToRoute(t *testing.T) {
+	for _, host := range []string{"volume-1" + adminRouteDomain, "VOLUME-1.ONLINECONF-CSI.INVALID."} {
+		_, err := readVolumeContext(map[string]string{"uri": "http://onlineconf.example.com", "notifyURL": "http://" + host + "/hook"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: unexpected error: %v", host, err)
+		}
+	}
+}
+
+func TestChangedModules(t *testing.T) {
+	old := volumeData{"TREE.cdb": []byte("1"), "TREE.conf": []byte("1"), "a.cdb": []byte("1"), "b.cdb": []byte("1")}
+	new := volumeData{"TREE.cdb": []byte("2"), "TREE.conf": []byte("2"), "a.cdb": []byte("1"), "c.cdb": []byte("1")}
+	if modules := changedModules(old, new); !reflect.DeepEqual(modules, []string{"TREE", "b", "c"}) {
+		t.Errorf("invalid changed modules: %v", modules)
+	}
+}
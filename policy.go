@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+)
+
+// volumePolicy restricts volumes which can be created by the controller and staged by nodes.
+// It is loaded from a YAML file:
+//
+//	uris:
+//	  - https://onlineconf.example.com
+//	  - https://onlineconf-*.example.com
+//	endpoints:
+//	  - prod
+//	notifyURLs:
+//	  - http://*.svc.cluster.local/*
+//	updateInterval:
+//	  min: 10s
+//	  max: 1h
+//	namespaces:
+//	  team-a:
+//	    uris:
+//	      - https://onlineconf-team-a.example.com
+//	    secretNamespaces:
+//	      - team-a
+//
+// Rules of a namespace are checked in addition to the global rules, so they can only narrow them.
+// The controller checks them for the namespace of the PVC, nodes for the namespace of every pod the volume is published to.
+type volumePolicy struct {
+	policyRules `yaml:",inline"`
+	Namespaces  map[string]policyRules `yaml:"namespaces"`
+}
+
+// policyRules are URL patterns (see urlPattern) allowed for volume attributes, patterns of allowed endpoint aliases
+// and namespaces of secrets (see path.Match) and limits of updateInterval.
+// An empty list of patterns or a zero limit doesn't restrict anything.
+type policyRules struct {
+	URIs             []string `yaml:"uris"`
+	Endpoints        []string `yaml:"endpoints"`
+	NotifyURLs       []string `yaml:"notifyURLs"`
+	Proxies          []string `yaml:"proxies"`
+	SecretNamespaces []string `yaml:"secretNamespaces"`
+	UpdateInterval   struct {
+		Min time.Duration `yaml:"min"`
+		Max time.Duration `yaml:"max"`
+	} `yaml:"updateInterval"`
+}
+
+func loadVolumePolicy(file string) (*volumePolicy, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var policy volumePolicy
+	if err := yaml.UnmarshalStrict(content, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", file, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	for ns, rules := range policy.Namespaces {
+		if err := rules.validate(); err != nil {
+			return nil, fmt.Errorf("invalid policy of namespace %q: %w", ns, err)
+		}
+	}
+	return &policy, nil
+}
+
+func (r *policyRules) validate() error {
+	for _, patterns := range [][]string{r.Endpoints, r.SecretNamespaces} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	for _, patterns := range [][]string{r.URIs, r.NotifyURLs, r.Proxies} {
+		for _, pattern := range patterns {
+			if _, err := parseURLPattern(pattern); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	if r.UpdateInterval.Max != 0 && r.UpdateInterval.Min > r.UpdateInterval.Max {
+		return fmt.Errorf("updateInterval min %v is greater than max %v", r.UpdateInterval.Min, r.UpdateInterval.Max)
+	}
+	return nil
+}
+
+// setUpdateIntervalLimits sets the global limits of updateInterval given by -min-update-interval and -max-update-interval flags.
+// The flags are a shorthand for the updateInterval rule of the policy, so they can't be used together.
+func (p *volumePolicy) setUpdateIntervalLimits(min, max time.Duration) error {
+	if min == 0 && max == 0 {
+		return nil
+	}
+	if p.UpdateInterval.Min != 0 || p.UpdateInterval.Max != 0 {
+		return fmt.Errorf("updateInterval limits are set both by flags and by the policy")
+	}
+	p.UpdateInterval.Min, p.UpdateInterval.Max = min, max
+	return p.validate()
+}
+
+// check returns PermissionDenied if the volume violates the global rules.
+func (p *volumePolicy) check(volCtx *volumeContext) error {
+	return p.policyRules.check(volCtx, "policy")
+}
+
+// checkNamespace returns PermissionDenied if the volume violates rules of the namespace.
+// The namespace must come from Kubernetes, not from volume attributes written by the author of a PV:
+// the controller uses the namespace of the PVC passed by the provisioner with --extra-create-metadata,
+// nodes use the namespace of the pod passed to NodePublishVolume with podInfoOnMount.
+func (p *volumePolicy) checkNamespace(namespace string, volCtx *volumeContext) error {
+	if rules, ok := p.Namespaces[namespace]; ok {
+		return rules.check(volCtx, fmt.Sprintf("policy of namespace %q", namespace))
+	}
+	return nil
+}
+
+// checkSecret returns PermissionDenied if the global rules or rules of the namespace don't allow secrets of secretNamespace.
+// The namespace must come from Kubernetes as for checkNamespace, only the global rules are checked if it is empty.
+func (p *volumePolicy) checkSecret(namespace, secretNamespace string) error {
+	if err := p.policyRules.checkSecret(secretNamespace, "policy"); err != nil {
+		return err
+	}
+	if rules, ok := p.Namespaces[namespace]; ok && namespace != "" {
+		return rules.checkSecret(secretNamespace, fmt.Sprintf("policy of namespace %q", namespace))
+	}
+	return nil
+}
+
+func (r *policyRules) checkSecret(secretNamespace, name string) error {
+	if len(r.SecretNamespaces) == 0 {
+		return nil
+	}
+	if secretNamespace == "" {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("secret doesn't declare its namespace in %q key required by %s", secretNamespaceKey, name))
+	}
+	if !matchName(r.SecretNamespaces, secretNamespace) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("secrets of namespace %q are not allowed by %s", secretNamespace, name))
+	}
+	return nil
+}
+
+// policyContext returns attributes of the staged volume checked by the policy.
+func (state *updaterState) policyContext() *volumeContext {
+	return &volumeContext{
+		uri:            state.URI,
+		endpoint:       state.Endpoint,
+		notifyURL:      state.NotifyURL,
+		httpProxy:      state.HTTPProxy,
+		updateInterval: state.UpdateInterval,
+	}
+}
+
+func (r *policyRules) check(volCtx *volumeContext, name string) error {
+	if volCtx.endpoint != "" {
+		// aliases are defined by the operator of the driver, so their URIs aren't checked
+		if !matchName(r.Endpoints, volCtx.endpoint) {
+			return status.Error(codes.PermissionDenied, fmt.Sprintf("endpoint %q is not allowed by %s", volCtx.endpoint, name))
+		}
+	} else if !matchURL(r.URIs, volCtx.uri) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("uri %q is not allowed by %s", volCtx.uri, name))
+	}
+	if volCtx.notifyURL != "" && !matchURL(r.NotifyURLs, volCtx.notifyURL) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("notifyURL %q is not allowed by %s", volCtx.notifyURL, name))
+	}
+	if volCtx.httpProxy != "" && !matchURL(r.Proxies, volCtx.httpProxy) {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("httpProxy %q is not allowed by %s", volCtx.httpProxy, name))
+	}
+	interval := volCtx.updateInterval
+	if interval == 0 {
+		interval = defaultUpdateInterval
+	}
+	if min := r.UpdateInterval.Min; min != 0 && interval < min {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("updateInterval %v is less than %v allowed by %s", interval, min, name))
+	}
+	if max := r.UpdateInterval.Max; max != 0 && interval > max {
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("updateInterval %v is greater than %v allowed by %s", interval, max, name))
+	}
+	return nil
+}
+
+// urlPattern is a parsed URL pattern: the scheme and the port must be equal, the host is matched with path.Match
+// and the path is a prefix of allowed paths. A trailing "*" of the path is the same as a trailing slash.
+type urlPattern struct {
+	scheme string
+	host   string
+	port   string
+	path   string
+}
+
+func parseURLPattern(pattern string) (urlPattern, error) {
+	u, err := url.Parse(pattern)
+	if err != nil {
+		return urlPattern{}, err
+	}
+	if u.Scheme == "" || u.Host == "" || u.Opaque != "" {
+		return urlPattern{}, fmt.Errorf("must be an absolute URL")
+	}
+	if u.User != nil || strings.ContainsAny(pattern, "?#") {
+		return urlPattern{}, fmt.Errorf("must not contain user info, query or fragment")
+	}
+	p := urlPattern{scheme: u.Scheme, host: normalizeHost(u.Hostname()), port: urlPort(u), path: strings.TrimSuffix(strings.TrimSuffix(u.Path, "*"), "/")}
+	if _, err := path.Match(p.host, ""); err != nil {
+		return urlPattern{}, err
+	}
+	if strings.ContainsAny(p.path, "*?[\\") {
+		return urlPattern{}, fmt.Errorf("path must be a prefix, only a trailing \"*\" is allowed")
+	}
+	return p, nil
+}
+
+func (p urlPattern) match(u *url.URL) bool {
+	if u.Scheme != p.scheme || urlPort(u) != p.port {
+		return false
+	}
+	if ok, _ := path.Match(p.host, normalizeHost(u.Hostname())); !ok {
+		return false
+	}
+	if p.path == "" {
+		return true
+	}
+	clean := path.Clean("/" + u.Path) // so that "/allowed/../other" doesn't match "/allowed"
+	return clean == p.path || strings.HasPrefix(clean, p.path+"/")
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// urlPort returns the port of the URL or the default port of its scheme.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch u.Scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	case "socks5":
+		return "1080"
+	}
+	return ""
+}
+
+// matchURL reports whether the URL matches any of patterns, its user info is ignored.
+// Any URL matches an empty list.
+func matchURL(patterns []string, rawURL string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if p, err := parseURLPattern(pattern); err == nil && p.match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName reports whether the name matches any of patterns, any name matches an empty list.
+func matchName(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/onlineconf/onlineconf/updater/v3/updater"
+	"github.com/rs/zerolog/log"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// probeAdmin makes a test request to onlineconf-admin of the volume being provisioned with the provisioner secret,
+// so that a bad uri, credentials or module fail CreateVolume instead of NodeStageVolume of the first pod.
+// Errors which can be fixed only by changing the storage class are reported as InvalidArgument or PermissionDenied,
+// others as Unavailable, so the provisioner retries.
+func probeAdmin(ctx context.Context, volCtx *volumeContext, creds adminCredentials, endpoints *endpointAliases) error {
+	if err := creds.validate(); err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid provisioner secret: %v", err))
+	}
+	if creds.tokenFile != "" || volCtx.tokenAudience != "" {
+		// the token file is on the node and pod tokens are issued after the volume is published, they can't be checked by the controller
+		log.Info().Str("uri", volCtx.uri).Msg("onlineconf-admin is not probed, credentials are available on the node only")
+		return nil
+	}
+	if volCtx.endpoint != "" && endpoints == nil {
+		log.Info().Str("endpoint", volCtx.endpoint).Msg("onlineconf-admin is not probed, endpoint aliases are not configured on the controller")
+		return nil
+	}
+	body, err := fetchAdminConfig(ctx, volCtx, creds, endpoints)
+	if err != nil {
+		return err
+	}
+	data, err := decodeConfigData(body)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid response of onlineconf-admin %s: %v", volCtx.uri, err))
+	}
+	if volCtx.module != "" && !configHasModule(data, volCtx.module) {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("module %q not found in configuration", volCtx.module))
+	}
+	return nil
+}
+
+// fetchAdminConfig requests the whole configuration from onlineconf-admin of the volume on behalf of the controller
+// and returns the raw response body.
+func fetchAdminConfig(ctx context.Context, volCtx *volumeContext, creds adminCredentials, endpoints *endpointAliases) ([]byte, error) {
+	state := updaterState{
+		URI:            volCtx.uri,
+		Endpoint:       volCtx.endpoint,
+		TLSMinVersion:  volCtx.tlsMinVersion,
+		TLSServerName:  volCtx.tlsServerName,
+		HTTPProxy:      volCtx.httpProxy,
+		NoProxy:        volCtx.noProxy,
+		RequestTimeout: volCtx.requestTimeout,
+		ConnectTimeout: volCtx.connectTimeout,
+	}
+	state.setCredentials(creds)
+	if state.Endpoint != "" {
+		if _, ok := endpoints.get(state.Endpoint); !ok {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown endpoint %q", state.Endpoint))
+		}
+		state = endpoints.resolve(state)
+	}
+
+	uri, err := url.Parse(state.URI)
+	if err != nil || uri.Scheme != "http" && uri.Scheme != "https" || uri.Host == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("uri must be an absolute http or https URL: %q", state.URI))
+	}
+	settings := state.transportSettings()
+	tlsConfig, err := settings.tlsConfig()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid TLS settings: %v", err))
+	}
+	transport := settings.newTransport(&http.Transport{Proxy: http.ProxyFromEnvironment}, tlsConfig)
+	defer transport.CloseIdleConnections()
+	if state.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, state.RequestTimeout)
+		defer cancel()
+	}
+
+	uri.User = nil
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(uri.String(), "/")+"/client/config", nil)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("uri invalid value: %v", err))
+	}
+	if state.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+state.Token)
+	} else {
+		req.SetBasicAuth(state.Username, state.Password)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, probeError(state.URI, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("onlineconf-admin %s rejected credentials: %s", state.URI, resp.Status))
+	case http.StatusNotFound:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("onlineconf-admin not found at %s: %s", state.URI, resp.Status))
+	default:
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("onlineconf-admin %s responded %s", state.URI, resp.Status))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, probeError(state.URI, err)
+	}
+	return body, nil
+}
+
+func decodeConfigData(body []byte) (*updater.ConfigData, error) {
+	var data updater.ConfigData
+	if err := codec.NewDecoderBytes(body, &codec.CborHandle{}).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// probeError converts an error of the test request to gRPC status.
+func probeError(uri string, err error) error {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound,
+		errors.As(err, &unknownAuthority),
+		errors.As(err, &hostname),
+		errors.As(err, &invalidCert):
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("failed to connect to onlineconf-admin %s: %v", uri, err))
+	default:
+		return status.Error(codes.Unavailable, fmt.Sprintf("failed to connect to onlineconf-admin %s: %v", uri, err))
+	}
+}
+
+func configHasModule(data *updater.ConfigData, module string) bool {
+	for _, m := range data.Modules {
+		if m == module {
+			return true
+		}
+	}
+	prefix := "/onlineconf/module/" + module
+	for _, node := range data.Nodes {
+		if node.Path == prefix || strings.HasPrefix(node.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
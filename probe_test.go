@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProbeAdmin(t *testing.T) {
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		admin.serveHTTP(w, r)
+	}))
+	defer auth.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+
+	for _, tc := range []struct {
+		name   string
+		volCtx volumeContext
+		creds  adminCredentials
+		code   codes.Code
+	}{
+		{"valid", volumeContext{uri: auth.URL, module: "TREE"}, adminCredentials{username: "user", password: "secret"}, codes.OK},
+		{"wrong password", volumeContext{uri: auth.URL}, adminCredentials{username: "user", password: "wrong"}, codes.PermissionDenied},
+		{"unknown module", volumeContext{uri: admin.URL, module: "UNKNOWN"}, adminCredentials{username: "user"}, codes.InvalidArgument},
+		{"not found", volumeContext{uri: notFound.URL}, adminCredentials{username: "user"}, codes.InvalidArgument},
+		{"relative uri", volumeContext{uri: "onlineconf.example.com"}, adminCredentials{username: "user"}, codes.InvalidArgument},
+		{"invalid secret", volumeContext{uri: admin.URL}, adminCredentials{token: "a", tokenFile: "/b"}, codes.InvalidArgument},
+		{"token file", volumeContext{uri: broken.URL}, adminCredentials{tokenFile: "/token"}, codes.OK},
+		{"unavailable", volumeContext{uri: broken.URL}, adminCredentials{username: "user"}, codes.Unavailable},
+	} {
+		if err := probeAdmin(context.Background(), &tc.volCtx, tc.creds, nil); status.Code(err) != tc.code {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+	}
+}
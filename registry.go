@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// registeredVolume is a volume created by the controller.
+type registeredVolume struct {
+	Id               string
+	Parameters       map[string]string // parameters of CreateVolumeRequest including ones inherited by a clone
+	VolumeContext    map[string]string
+	CapacityBytes    int64
+	SourceVolumeId   string `json:",omitempty"` // of a cloned volume
+	SourceSnapshotId string `json:",omitempty"` // of a volume created from a snapshot
+}
+
+// volumeRegistry persists volumes created by the controller.
+// Implementations must be safe for concurrent use.
+type volumeRegistry interface {
+	// get returns the volume or nil if it doesn't exist.
+	get(id string) (*registeredVolume, error)
+	put(volume registeredVolume) error
+	// delete removes the volume, it is not an error if the volume doesn't exist.
+	delete(id string) error
+	// list returns all volumes ordered by id.
+	list() ([]registeredVolume, error)
+}
+
+// openVolumeRegistry opens the registry given by URI, the scheme selects the backend:
+//
+//	file:///var/lib/onlineconf-csi-driver/volumes.json - a JSON file
+//
+// A plain path is the same as a file URI.
+func openVolumeRegistry(uri string) (volumeRegistry, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry URI: %w", err)
+	}
+	switch u.Scheme {
+	case "", "file":
+		return openFileRegistry(u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported registry backend: %q", u.Scheme)
+	}
+}
+
+// fileRegistry keeps all volumes in memory and writes them atomically into a JSON file after every change.
+type fileRegistry struct {
+	path    string
+	m       sync.Mutex
+	volumes map[string]registeredVolume
+}
+
+func openFileRegistry(path string) (*fileRegistry, error) {
+	if path == "" {
+		return nil, fmt.Errorf("registry file path is empty")
+	}
+	r := &fileRegistry{path: path, volumes: make(map[string]registeredVolume)}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+				return nil, err
+			}
+			return r, r.save()
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r.volumes); err != nil {
+		return nil, fmt.Errorf("failed to read registry file: %w", err)
+	}
+	return r, nil
+}
+
+func (r *fileRegistry) get(id string) (*registeredVolume, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if v, ok := r.volumes[id]; ok {
+		return &v, nil
+	}
+	return nil, nil
+}
+
+func (r *fileRegistry) put(volume registeredVolume) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	prev, existed := r.volumes[volume.Id]
+	r.volumes[volume.Id] = volume
+	if err := r.save(); err != nil {
+		if existed {
+			r.volumes[volume.Id] = prev
+		} else {
+			delete(r.volumes, volume.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *fileRegistry) delete(id string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	prev, ok := r.volumes[id]
+	if !ok {
+		return nil
+	}
+	delete(r.volumes, id)
+	if err := r.save(); err != nil {
+		r.volumes[id] = prev
+		return err
+	}
+	return nil
+}
+
+func (r *fileRegistry) list() ([]registeredVolume, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	volumes := make([]registeredVolume, 0, len(r.volumes))
+	for _, v := range r.volumes {
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Id < volumes[j].Id })
+	return volumes, nil
+}
+
+func (r *fileRegistry) save() error {
+	content, err := json.Marshal(r.volumes)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.path, append(content, '\n'), 0600)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onlineconf-csi-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry", "volumes.json")
+
+	r, err := openVolumeRegistry("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"b", "a"} {
+		if err := r.put(registeredVolume{Id: id, Parameters: map[string]string{"uri": "http://" + id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.delete("unknown"); err != nil {
+		t.Errorf("delete of unknown volume: %v", err)
+	}
+
+	r, err = openVolumeRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.get("a"); err != nil || v == nil || v.Parameters["uri"] != "http://a" {
+		t.Errorf("volume is not persisted: %+v, %v", v, err)
+	}
+	if err := r.delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := r.get("a"); err != nil || v != nil {
+		t.Errorf("volume is not deleted: %+v, %v", v, err)
+	}
+	if volumes, err := r.list(); err != nil || len(volumes) != 1 || volumes[0].Id != "b" {
+		t.Errorf("unexpected volumes: %+v, %v", volumes, err)
+	}
+	if _, err := openVolumeRegistry("etcd://localhost"); err == nil {
+		t.Error("unknown backend is accepted")
+	}
+}
+
+func TestControllerRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onlineconf-csi-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, err := openFileRegistry(filepath.Join(dir, "volumes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := newControllerServer(registry, nil, nil)
+	ctx := context.Background()
+	volCaps := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}}
+	create := func(name, uri string) error {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: volCaps,
+			Parameters:         map[string]string{"uri": uri},
+		})
+		return err
+	}
+
+	for _, name := range []string{"vol-1", "vol-2", "vol-3"} {
+		if err := create(name, "http://onlineconf.example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := create("vol-1", "http://onlineconf.example.com"); err != nil {
+		t.Errorf("repeated creation failed: %v", err)
+	}
+	if err := create("vol-1", "http://other.example.com"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("creation with different parameters: unexpected error: %v", err)
+	}
+
+	var ids []string
+	req := &csi.ListVolumesRequest{MaxEntries: 2}
+	for {
+		resp, err := cs.ListVolumes(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range resp.GetEntries() {
+			ids = append(ids, e.GetVolume().GetVolumeId())
+		}
+		if resp.GetNextToken() == "" {
+			break
+		}
+		req.StartingToken = resp.GetNextToken()
+	}
+	if len(ids) != 3 || ids[0] != "vol-1" || ids[2] != "vol-3" {
+		t.Errorf("unexpected list of volumes: %v", ids)
+	}
+	if _, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "unknown"}); status.Code(err) != codes.Aborted {
+		t.Errorf("invalid starting token: unexpected error: %v", err)
+	}
+
+	if resp, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "vol-2"}); err != nil || resp.GetVolume().GetVolumeContext()["uri"] != "http://onlineconf.example.com" {
+		t.Errorf("unexpected volume: %v, %v", resp, err)
+	}
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "vol-2"}); status.Code(err) != codes.NotFound {
+		t.Errorf("deleted volume: unexpected error: %v", err)
+	}
+	if _, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "vol-2", VolumeCapabilities: volCaps}); status.Code(err) != codes.NotFound {
+		t.Errorf("validation of deleted volume: unexpected error: %v", err)
+	}
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-2"}); err != nil {
+		t.Errorf("repeated deletion failed: %v", err)
+	}
+}
+
+func TestCloneVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onlineconf-csi-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, err := openFileRegistry(filepath.Join(dir, "volumes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := newControllerServer(registry, nil, nil)
+	ctx := context.Background()
+	volCaps := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}}
+	clone := func(source string, params map[string]string) (*csi.Volume, error) {
+		resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "clone",
+			VolumeCapabilities: volCaps,
+			Parameters:         params,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: source}},
+			},
+		})
+		return resp.GetVolume(), err
+	}
+
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "source",
+		VolumeCapabilities: volCaps,
+		Parameters: map[string]string{
+			"uri":                              "http://onlineconf.example.com",
+			"module":                           "TREE",
+			"${env}":                           "production",
+			"${pvc}":                           "${pvc.name}",
+			"csi.storage.k8s.io/pvc/name":      "source-pvc",
+			"csi.storage.k8s.io/pvc/namespace": "default",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clone("unknown", nil); status.Code(err) != codes.NotFound {
+		t.Errorf("clone of unknown volume: unexpected error: %v", err)
+	}
+	params := map[string]string{"${env}": "staging", "csi.storage.k8s.io/pvc/name": "clone-pvc"}
+	volume, err := clone("source", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"uri": "http://onlineconf.example.com", "module": "TREE", "${env}": "staging", "${pvc}": "clone-pvc"}
+	if !reflect.DeepEqual(volume.GetVolumeContext(), expected) {
+		t.Errorf("unexpected volume context of the clone: %v", volume.GetVolumeContext())
+	}
+	if volume.GetContentSource().GetVolume().GetVolumeId() != "source" {
+		t.Errorf("unexpected content source of the clone: %v", volume.GetContentSource())
+	}
+	if _, err := clone("source", params); err != nil {
+		t.Errorf("repeated clone failed: %v", err)
+	}
+	if _, err := clone("source", map[string]string{"${env}": "testing"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("clone with different parameters: unexpected error: %v", err)
+	}
+
+	if _, err := newControllerServer(nil, nil, nil).CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "clone",
+		VolumeCapabilities: volCaps,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "source"}},
+		},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("clone without registry: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// restagePolicy defines what NodeStageVolume does when it is called again for a staged volume with changed volume context.
+type restagePolicy string
+
+const (
+	restageReconfigure restagePolicy = "reconfigure" // apply the new context to the running updater
+	restageRestart     restagePolicy = "restart"     // stop the updater and start a new one with the new context
+	restageReject      restagePolicy = "reject"      // fail with FailedPrecondition
+)
+
+func parseRestagePolicy(policy string) (restagePolicy, error) {
+	switch p := restagePolicy(policy); p {
+	case restageReconfigure, restageRestart, restageReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unsupported restage policy: %q", policy)
+	}
+}
+
+// contextChanges returns names of volume attributes and mount flags which differ between the states.
+// The frozen attribute is ignored, the volume could be frozen or unfrozen with the admin API.
+func contextChanges(old, new updaterState) []string {
+	var changes []string
+	check := func(name string, changed bool) {
+		if changed {
+			changes = append(changes, name)
+		}
+	}
+	check("uri", old.URI != new.URI)
+	check("endpoint", old.Endpoint != new.Endpoint)
+	check("updateInterval", old.UpdateInterval != new.UpdateInterval)
+	check("module", old.Module != new.Module)
+	check("path", old.Path != new.Path)
+	check("format", old.Format != new.Format)
+	check("keepCDB", old.KeepCDB != new.KeepCDB)
+	check("notifyURL", old.NotifyURL != new.NotifyURL)
+	check("auditHistory", old.AuditHistory != new.AuditHistory)
+	check("tlsMinVersion", old.TLSMinVersion != new.TLSMinVersion)
+	check("tlsServerName", old.TLSServerName != new.TLSServerName)
+	check("serviceAccountTokenAudience", old.TokenAudience != new.TokenAudience)
+	check("httpProxy", old.HTTPProxy != new.HTTPProxy)
+	check("noProxy", old.NoProxy != new.NoProxy)
+	check("requestTimeout", old.RequestTimeout != new.RequestTimeout)
+	check("connectTimeout", old.ConnectTimeout != new.ConnectTimeout)
+	check("snapshot", old.Snapshot != new.Snapshot)
+	check("uid", old.UID != new.UID)
+	check("gid", old.GID != new.GID)
+	check("context", old.SELinuxContext != new.SELinuxContext)
+	var vars []string
+	for k, v := range new.Variables {
+		if ov, ok := old.Variables[k]; !ok || ov != v {
+			vars = append(vars, "${"+k+"}")
+		}
+	}
+	for k := range old.Variables {
+		if _, ok := new.Variables[k]; !ok {
+			vars = append(vars, "${"+k+"}")
+		}
+	}
+	sort.Strings(vars)
+	return append(changes, vars...)
+}
+
+// ownershipMountFlags are mount flags applied to files of all generations kept on the node,
+// so they can't be changed without unstaging the volume.
+var ownershipMountFlags = map[string]bool{"uid": true, "gid": true, "context": true}
+
+// restage applies the changed volume context according to the restage policy.
+// It must be called with ns.m held.
+func (ns *nodeServer) restage(volumeId string, old, new updaterState, changes []string) error {
+	log.Info().Str("volume_id", volumeId).Strs("changes", changes).Str("policy", string(ns.config.restagePolicy)).Msg("volume context changed")
+	ui := ns.updaters[old.DataDir]
+
+	var flags []string
+	for _, name := range changes {
+		if ownershipMountFlags[name] {
+			flags = append(flags, name)
+		}
+	}
+
+	switch {
+	case len(flags) > 0:
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("mount flags %v of a staged volume can't be changed, it must be unstaged first", flags))
+	case old.Snapshot != "" || new.Snapshot != "":
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("attributes of a volume created from a snapshot can't be changed %v", changes))
+	case ns.config.restagePolicy == restageReject:
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("volume is already staged with different attributes %v", changes))
+	case ui == nil:
+		// the updater is not running, the new context is used when it is started
+	case ns.config.restagePolicy == restageRestart:
+		ns.stopUpdater(ui)
+		if err := ns.runUpdater(volumeId, new, false); err != nil {
+			log.Error().Err(err).Str("volume_id", volumeId).Msg("failed to restart updater, restoring the previous one")
+			if err := ns.runUpdater(volumeId, old, true); err != nil {
+				log.Error().Err(err).Str("volume_id", volumeId).Msg("failed to restore updater")
+			}
+			return updateError(new, err)
+		}
+	default:
+		if err := ns.reconfigureUpdater(ui, new); err != nil {
+			log.Error().Err(err).Str("volume_id", volumeId).Msg("failed to reconfigure updater, restoring the previous configuration")
+			if err := ns.reconfigureUpdater(ui, old); err != nil {
+				log.Error().Err(err).Str("volume_id", volumeId).Msg("failed to restore updater configuration")
+			}
+			return updateError(new, err)
+		}
+	}
+
+	ns.state.Updaters[volumeId] = new
+	if err := ns.state.save(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// reconfigureUpdater applies the state to the running updater and updates the volume immediately.
+// It must be called with ns.m held, which is released while waiting for the update.
+func (ns *nodeServer) reconfigureUpdater(ui *updaterInfo, state updaterState) error {
+	if err := ns.router.update(ui.routeURI, ns.config.withDefaults(state)); err != nil {
+		return err
+	}
+
+	ui.m.Lock()
+	oldNotifier := ui.notifier
+	if state.NotifyURL != ui.state.NotifyURL {
+		ui.notifier = nil
+		if state.NotifyURL != "" {
+			ui.notifier = newNotifier(state.NotifyURL)
+		}
+	} else {
+		oldNotifier = nil
+	}
+	ui.updater = newUpdater(ui.routeURI, state) // a new one performs full update, so the changed context is applied to all data
+	ui.state = state
+	ui.m.Unlock()
+	if oldNotifier != nil {
+		oldNotifier.stop()
+	}
+
+	interval := state.UpdateInterval
+	if interval == 0 {
+		interval = defaultUpdateInterval
+	}
+	ns.scheduler.setInterval(ui, interval)
+
+	return ns.unlocked(ui.volumeId, ui.state.DataDir, func() error { return ns.scheduler.updateNow(ui) })
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContextChanges(t *testing.T) {
+	old := updaterState{URI: "http://a", Module: "TREE", Frozen: true, Variables: map[string]string{"x": "1", "y": "2"}}
+	if changes := contextChanges(old, old); len(changes) != 0 {
+		t.Errorf("unchanged state: %v", changes)
+	}
+	new := updaterState{URI: "http://b", Module: "TREE", GID: 1000, Chown: true, Variables: map[string]string{"y": "3", "z": "4"}}
+	expected := []string{"uri", "gid", "${x}", "${y}", "${z}"}
+	if changes := contextChanges(old, new); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("invalid changes: %v, expected %v", changes, expected)
+	}
+}
+
+func TestRestage(t *testing.T) {
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	ns, dir := testNodeServer(t)
+	defer os.RemoveAll(dir)
+	defer ns.stop()
+
+	var mountFlags []string
+	stage := func(volCtx map[string]string) error {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-1",
+			StagingTargetPath: filepath.Join(dir, "stage"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: mountFlags}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			},
+			VolumeContext: volCtx,
+		})
+		return err
+	}
+	if err := stage(map[string]string{"uri": admin.URL + "/a", "module": "TREE"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stage(map[string]string{"uri": admin.URL + "/a", "module": "TREE"}); err != nil {
+		t.Errorf("unchanged context: %v", err)
+	}
+
+	if err := stage(map[string]string{"uri": admin.URL + "/b", "module": "TREE", "updateInterval": "1m"}); err != nil {
+		t.Fatalf("reconfigure: %v", err)
+	}
+	if admin.count("/b") != 1 {
+		t.Error("reconfigured volume is not updated from the new uri")
+	}
+	if us := ns.state.Updaters["vol-1"]; us.URI != admin.URL+"/b" {
+		t.Errorf("new context is not persisted: %+v", us)
+	}
+
+	mountFlags = []string{"gid=1000"}
+	if err := stage(map[string]string{"uri": admin.URL + "/b", "module": "TREE", "updateInterval": "1m"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("changed gid: unexpected error: %v", err)
+	}
+	if us := ns.state.Updaters["vol-1"]; us.Chown || us.GID != -1 {
+		t.Errorf("changed gid is persisted: %+v", us)
+	}
+	for _, mode := range []os.FileMode{0750, 0755} {
+		mountFlags = []string{fmt.Sprintf("mode=%o", mode)}
+		if err := stage(map[string]string{"uri": admin.URL + "/b", "module": "TREE", "updateInterval": "1m"}); err != nil {
+			t.Errorf("changed mode: %v", err)
+		}
+		if info, err := os.Stat(filepath.Join(dir, "stage")); err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != mode {
+			t.Errorf("changed mode %o is not applied: %v", mode, info.Mode())
+		}
+	}
+	mountFlags = nil
+
+	ns.config.restagePolicy = restageRestart
+	if err := stage(map[string]string{"uri": admin.URL + "/c", "module": "TREE"}); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	if admin.count("/c") != 1 || len(ns.updaters) != 1 {
+		t.Error("restarted volume is not updated from the new uri")
+	}
+	if err := stage(map[string]string{"uri": admin.URL + "/c", "module": "UNKNOWN"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("restart with unknown module: unexpected error: %v", err)
+	}
+	if ui := ns.updaters[filepath.Join(dir, "stage")]; ui == nil || ui.state.Module != "TREE" {
+		t.Error("previous updater is not restored")
+	}
+	if us := ns.state.Updaters["vol-1"]; us.Module != "TREE" {
+		t.Errorf("failed context is persisted: %+v", us)
+	}
+
+	ns.config.restagePolicy = restageReject
+	if err := stage(map[string]string{"uri": admin.URL + "/d", "module": "TREE"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("reject: unexpected error: %v", err)
+	}
+	if us := ns.state.Updaters["vol-1"]; us.URI != admin.URL+"/c" {
+		t.Errorf("rejected context is persisted: %+v", us)
+	}
+}
@@ -13,9 +13,18 @@ func TestSanity(t *testing.T) {
 	sanityTest = true
 	endpoint := "unix://" + os.TempDir() + "/onlineconf-csi.sock"
 
+	registry, err := openVolumeRegistry(os.TempDir() + "/onlineconf-csi-volumes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(os.TempDir() + "/onlineconf-csi-volumes.json")
+
 	d := newDriver()
-	d.initControllerServer()
-	d.initNodeServer("1234567890", os.TempDir()+"/onlineconf-csi-state.json")
+	d.initControllerServer(registry, nil, nil)
+	d.initNodeServer("1234567890", nodeConfig{
+		stateFile:   os.TempDir() + "/onlineconf-csi-state.json",
+		generations: 3,
+	})
 	go d.run(endpoint)
 	defer d.stop()
 
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var errSchedulerStopped = errors.New("scheduler stopped")
+
+// scheduler performs updates of all volumes of the node.
+// A single loop keeps volumes in a heap ordered by the time of their next update
+// and hands due volumes over to a fixed pool of workers, which limits the number of concurrent requests to onlineconf-admin.
+// Update intervals are randomly changed by jitter so that volumes are not updated simultaneously.
+// The first update of a volume being staged is performed by the first free worker ahead of all due background updates.
+type scheduler struct {
+	workers int
+	jitter  float64
+
+	m       sync.Mutex
+	idle    sync.Cond // signaled when an update finishes
+	queue   scheduleQueue
+	entries map[*updaterInfo]*scheduleEntry
+	rand    *rand.Rand
+
+	wake       chan struct{}
+	stage      chan *stageJob
+	background chan *scheduleEntry
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+type scheduleEntry struct {
+	ui       *updaterInfo
+	next     time.Time
+	index    int // index in the heap, -1 if the entry is not in it
+	running  bool
+	removed  bool
+	interval time.Duration
+}
+
+type stageJob struct {
+	ui     *updaterInfo
+	result chan error
+}
+
+func newScheduler(workers int, jitter float64) *scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	s := &scheduler{
+		workers:    workers,
+		jitter:     jitter,
+		entries:    make(map[*updaterInfo]*scheduleEntry),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		wake:       make(chan struct{}, 1),
+		stage:      make(chan *stageJob),
+		background: make(chan *scheduleEntry),
+		done:       make(chan struct{}),
+	}
+	s.idle.L = &s.m
+	s.wg.Add(1 + workers)
+	go s.run()
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+func (s *scheduler) stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// updateNow performs the update of the volume being staged as soon as a worker is free.
+// It waits for a scheduled update of the volume running at the same time, updates of a volume never overlap.
+func (s *scheduler) updateNow(ui *updaterInfo) error {
+	job := &stageJob{ui: ui, result: make(chan error, 1)}
+	select {
+	case s.stage <- job:
+		return <-job.result
+	case <-s.done:
+		return errSchedulerStopped
+	}
+}
+
+// add schedules periodic updates of the volume, the first one is performed after firstDelay.
+func (s *scheduler) add(ui *updaterInfo, interval, firstDelay time.Duration) {
+	s.m.Lock()
+	e := &scheduleEntry{ui: ui, next: time.Now().Add(firstDelay), interval: interval}
+	s.entries[ui] = e
+	heap.Push(&s.queue, e)
+	s.m.Unlock()
+	s.notify()
+}
+
+// setInterval changes the update interval of the volume, the next update is rescheduled according to it.
+func (s *scheduler) setInterval(ui *updaterInfo, interval time.Duration) {
+	s.m.Lock()
+	e := s.entries[ui]
+	if e == nil || e.interval == interval {
+		s.m.Unlock()
+		return
+	}
+	e.interval = interval
+	if e.index >= 0 {
+		e.next = time.Now().Add(s.delayLocked(interval))
+		heap.Fix(&s.queue, e.index)
+	}
+	s.m.Unlock()
+	s.notify()
+}
+
+// remove stops updates of the volume and waits for the running one to finish.
+func (s *scheduler) remove(ui *updaterInfo) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	e := s.entries[ui]
+	if e == nil {
+		return
+	}
+	delete(s.entries, ui)
+	e.removed = true
+	if e.index >= 0 {
+		heap.Remove(&s.queue, e.index)
+	}
+	for e.running {
+		s.idle.Wait()
+	}
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) run() {
+	defer s.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		var due *scheduleEntry
+		s.m.Lock()
+		if len(s.queue) > 0 {
+			if d := time.Until(s.queue[0].next); d <= 0 {
+				due = heap.Pop(&s.queue).(*scheduleEntry)
+			} else {
+				resetTimer(timer, d)
+			}
+		}
+		s.m.Unlock()
+
+		if due != nil {
+			select {
+			case s.background <- due:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *scheduler) work() {
+	defer s.wg.Done()
+	for {
+		select {
+		case job := <-s.stage:
+			job.result <- job.ui.update()
+			continue
+		default:
+		}
+		select {
+		case job := <-s.stage:
+			job.result <- job.ui.update()
+		case e := <-s.background:
+			s.updateEntry(e)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *scheduler) updateEntry(e *scheduleEntry) {
+	s.m.Lock()
+	if e.removed {
+		s.m.Unlock()
+		return
+	}
+	e.running = true
+	s.m.Unlock()
+
+	e.ui.update()
+
+	s.m.Lock()
+	e.running = false
+	s.idle.Broadcast()
+	if !e.removed {
+		e.next = time.Now().Add(s.delayLocked(e.interval))
+		heap.Push(&s.queue, e)
+	}
+	s.m.Unlock()
+	s.notify()
+}
+
+// phase returns a random delay of the first update of a volume restored after restart,
+// so that volumes are not updated simultaneously.
+func (s *scheduler) phase(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return time.Duration(s.rand.Int63n(int64(interval)))
+}
+
+// delay returns interval randomly changed by up to jitter fraction of it.
+func (s *scheduler) delay(interval time.Duration) time.Duration {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.delayLocked(interval)
+}
+
+func (s *scheduler) delayLocked(interval time.Duration) time.Duration {
+	return interval + time.Duration((2*s.rand.Float64()-1)*s.jitter*float64(interval))
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// scheduleQueue is a heap of volumes ordered by the time of their next update.
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	e := x.(*scheduleEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/onlineconf/onlineconf/updater/v3/updater"
+	"github.com/rs/zerolog"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeAdmin serves the same configuration to every client and counts requests by URI path prefix.
+type fakeAdmin struct {
+	*httptest.Server
+	body []byte
+
+	m        sync.Mutex
+	requests map[string]int
+	total    int
+}
+
+func newFakeAdmin(t testing.TB) *fakeAdmin {
+	data := updater.ConfigData{
+		Modules: []string{"TREE"},
+		Nodes: []updater.ConfigParam{
+			{Path: "/onlineconf/module/TREE", ContentType: "application/x-null"},
+			{Path: "/onlineconf/module/TREE/a", ContentType: "text/plain", Value: updater.NullString{NullString: sql.NullString{String: "1", Valid: true}}},
+		},
+	}
+	var body []byte
+	if err := codec.NewEncoderBytes(&body, &codec.CborHandle{}).Encode(&data); err != nil {
+		t.Fatal(err)
+	}
+	fa := &fakeAdmin{body: body, requests: make(map[string]int)}
+	fa.Server = httptest.NewServer(http.HandlerFunc(fa.serveHTTP))
+	return fa
+}
+
+func (fa *fakeAdmin) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fa.m.Lock()
+	fa.requests[strings.TrimSuffix(r.URL.Path, "/client/config")]++
+	fa.total++
+	fa.m.Unlock()
+	if r.Header.Get("X-OnlineConf-Client-Mtime") == "1" {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("X-OnlineConf-Admin-Last-Modified", "1")
+	w.Write(fa.body)
+}
+
+func (fa *fakeAdmin) count(prefix string) int {
+	fa.m.Lock()
+	defer fa.m.Unlock()
+	if prefix == "" {
+		return fa.total
+	}
+	return fa.requests[prefix]
+}
+
+func testUpdaterInfo(t testing.TB, dir, uri, volumeId string) *updaterInfo {
+	state := updaterState{
+		DataDir: filepath.Join(dir, volumeId, "stage"),
+		WorkDir: filepath.Join(dir, volumeId, "work"),
+		URI:     uri,
+	}
+	for _, d := range []string{state.DataDir, state.WorkDir} {
+		if err := os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &updaterInfo{
+		volumeId:    volumeId,
+		state:       state,
+		generations: 3,
+		updater:     updater.NewUpdater(updater.UpdaterConfig{Admin: updater.AdminConfig{URI: uri}, DataDir: state.WorkDir}),
+		status:      newVolumeStatus(state),
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onlineconf-csi-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	s := newScheduler(2, 0.1)
+	defer s.stop()
+
+	var uis []*updaterInfo
+	for i := 0; i < 3; i++ {
+		ui := testUpdaterInfo(t, dir, admin.URL+fmt.Sprintf("/vol-%d", i), fmt.Sprintf("vol-%d", i))
+		if err := s.updateNow(ui); err != nil {
+			t.Fatal(err)
+		}
+		if ui.status.Generation != 1 {
+			t.Errorf("%s: volume is not rendered by the stage update", ui.volumeId)
+		}
+		s.add(ui, 10*time.Millisecond, s.phase(10*time.Millisecond))
+		uis = append(uis, ui)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, ui := range uis {
+		for admin.count("/"+ui.volumeId) < 4 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: volume is not updated periodically", ui.volumeId)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	s.remove(uis[0])
+	removed := admin.count("/vol-0")
+	for admin.count("/vol-1") < removed+4 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := admin.count("/vol-0"); n != removed {
+		t.Errorf("removed volume is updated %d times", n-removed)
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := s.delay(10 * time.Second); d < 9*time.Second || d > 11*time.Second {
+			t.Errorf("delay %v is out of jitter", d)
+		}
+		if d := s.phase(10 * time.Second); d < 0 || d >= 10*time.Second {
+			t.Errorf("phase %v is out of interval", d)
+		}
+	}
+}
+
+func TestSchedulerUpdateNow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "onlineconf-csi-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	var m sync.Mutex
+	inFlight, overlaps := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		inFlight++
+		if inFlight > 1 {
+			overlaps++
+		}
+		m.Unlock()
+		time.Sleep(time.Millisecond)
+		admin.serveHTTP(w, r)
+		m.Lock()
+		inFlight--
+		m.Unlock()
+	}))
+	defer server.Close()
+	s := newScheduler(4, 0)
+	defer s.stop()
+
+	ui := testUpdaterInfo(t, dir, server.URL, "vol-1")
+	if err := s.updateNow(ui); err != nil {
+		t.Fatal(err)
+	}
+	s.add(ui, time.Millisecond, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s.updateNow(ui)
+			}
+		}()
+	}
+	wg.Wait()
+	s.remove(ui)
+	if overlaps != 0 {
+		t.Errorf("updates of the volume overlapped %d times", overlaps)
+	}
+}
+
+// BenchmarkScheduler polls 5000 volumes against an in-process fake admin.
+// Every iteration is one full round of updates of all volumes.
+func BenchmarkScheduler(b *testing.B) {
+	const volumes = 5000
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	dir, err := ioutil.TempDir("", "onlineconf-csi-scheduler")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	admin := newFakeAdmin(b)
+	defer admin.Close()
+	installAdminRouter(8)
+	s := newScheduler(8, 0.1)
+	defer s.stop()
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < volumes; i++ {
+		id := fmt.Sprintf("vol-%d", i)
+		ui := testUpdaterInfo(b, dir, admin.URL+"/"+id, id)
+		if err := s.updateNow(ui); err != nil {
+			b.Fatal(err)
+		}
+		s.add(ui, 100*time.Millisecond, s.phase(100*time.Millisecond))
+	}
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	heapPerVolume := float64(after.HeapAlloc-before.HeapAlloc) / volumes
+	goroutines = runtime.NumGoroutine() - goroutines
+
+	var rusageBefore, rusageAfter syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &rusageBefore)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := admin.count("") + volumes
+		for admin.count("") < target {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	b.StopTimer()
+	syscall.Getrusage(syscall.RUSAGE_SELF, &rusageAfter)
+	cpu := time.Duration(rusageAfter.Utime.Nano() + rusageAfter.Stime.Nano() - rusageBefore.Utime.Nano() - rusageBefore.Stime.Nano())
+	b.ReportMetric(float64(cpu.Microseconds())/float64(b.N*volumes), "cpu-us/update") // including the fake admin
+	b.ReportMetric(heapPerVolume, "heap-B/volume")
+	b.ReportMetric(float64(goroutines), "goroutines")
+}
+
+func TestNodeStageUnlocked(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	ns, dir := testNodeServer(t)
+	defer os.RemoveAll(dir)
+	ns.scheduler.stop()
+	ns.scheduler = newScheduler(2, 0) // one worker waits for the hung onlineconf-admin
+	defer ns.stop()
+	stage := func(volumeId, uri string) error {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeId,
+			StagingTargetPath: filepath.Join(dir, volumeId),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+			},
+			VolumeContext: map[string]string{"uri": uri},
+		})
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- stage("vol-1", hung.URL) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		ns.m.Lock()
+		_, busy := ns.busy["vol-1"]
+		ns.m.Unlock()
+		if busy {
+			break
+		} else if time.Now().After(deadline) {
+			t.Error("volume is not marked busy while waiting for the first update")
+			break
+		}
+	}
+
+	if err := stage("vol-2", admin.URL); err != nil {
+		t.Errorf("volume is not staged while another one waits for a hung onlineconf-admin: %v", err)
+	}
+	if err := stage("vol-1", hung.URL); status.Code(err) != codes.Aborted {
+		t.Errorf("concurrent stage of the busy volume: unexpected error: %v", err)
+	}
+	_, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "vol-1", StagingTargetPath: filepath.Join(dir, "vol-1")})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("concurrent unstage of the busy volume: unexpected error: %v", err)
+	}
+	close(release)
+	<-result
+	if len(ns.busy) != 0 {
+		t.Errorf("volumes are left busy: %v", ns.busy)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storedSnapshot is a configuration of onlineconf-admin captured by CreateSnapshot.
+type storedSnapshot struct {
+	Id             string
+	SourceVolumeId string
+	Parameters     map[string]string // of the source volume, inherited by volumes created from the snapshot
+	Namespace      string            // of the PVC of the source volume, volumes created from the snapshot are published to its pods only
+	CreationTime   time.Time
+	SizeBytes      int64
+}
+
+// snapshotStore keeps snapshots shared by the controller, which creates them, and nodes, which stage volumes from them.
+// Implementations must be safe for concurrent use.
+type snapshotStore interface {
+	// get returns the snapshot or nil if it doesn't exist.
+	get(id string) (*storedSnapshot, error)
+	// put stores the snapshot with its data, the raw response of onlineconf-admin.
+	put(snapshot storedSnapshot, data []byte) error
+	// data returns data of the snapshot.
+	data(id string) ([]byte, error)
+	// delete removes the snapshot, it is not an error if the snapshot doesn't exist.
+	delete(id string) error
+	// list returns all snapshots ordered by id.
+	list() ([]storedSnapshot, error)
+}
+
+// openSnapshotStore opens the store given by URI, the scheme selects the backend:
+//
+//	file:///var/lib/onlineconf-csi-driver/snapshots - a directory, it must be shared by the controller and all nodes
+//
+// A plain path is the same as a file URI.
+func openSnapshotStore(uri string) (snapshotStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot store URI: %w", err)
+	}
+	switch u.Scheme {
+	case "", "file":
+		return openFileSnapshotStore(u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported snapshot store backend: %q", u.Scheme)
+	}
+}
+
+// fileSnapshotStore keeps every snapshot in two files: "<id>.cbor" with data and "<id>.json" with metadata.
+// Metadata is written after data, so a snapshot exists only if it is complete.
+type fileSnapshotStore struct {
+	dir string
+	m   sync.Mutex
+}
+
+func openFileSnapshotStore(dir string) (*fileSnapshotStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("snapshot store directory is empty")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSnapshotStore{dir: dir}, nil
+}
+
+func (s *fileSnapshotStore) file(id, ext string) string {
+	name := url.PathEscape(id)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return filepath.Join(s.dir, name+ext)
+}
+
+func (s *fileSnapshotStore) get(id string) (*storedSnapshot, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.read(s.file(id, ".json"))
+}
+
+func (s *fileSnapshotStore) read(path string) (*storedSnapshot, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snapshot storedSnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", path, err)
+	}
+	return &snapshot, nil
+}
+
+func (s *fileSnapshotStore) put(snapshot storedSnapshot, data []byte) error {
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := writeFileAtomic(s.file(snapshot.Id, ".cbor"), data, 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file(snapshot.Id, ".json"), append(content, '\n'), 0600)
+}
+
+func (s *fileSnapshotStore) data(id string) ([]byte, error) {
+	return ioutil.ReadFile(s.file(id, ".cbor"))
+}
+
+func (s *fileSnapshotStore) delete(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := os.Remove(s.file(id, ".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.file(id, ".cbor")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileSnapshotStore) list() ([]storedSnapshot, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]storedSnapshot, 0, len(paths))
+	for _, path := range paths {
+		snapshot, err := s.read(path)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot != nil {
+			snapshots = append(snapshots, *snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Id < snapshots[j].Id })
+	return snapshots, nil
+}
+
+var (
+	errSnapshotsNotSupported = errors.New("snapshot store is not configured on the node")
+	errSnapshotNotFound      = errors.New("snapshot not found")
+)
+
+// snapshotNamespace returns the namespace the snapshot a volume is staged from belongs to.
+func (ns *nodeServer) snapshotNamespace(id string) (string, error) {
+	if ns.config.snapshots == nil {
+		return "", errSnapshotsNotSupported
+	}
+	snapshot, err := ns.config.snapshots.get(id)
+	if err != nil {
+		return "", err
+	}
+	if snapshot == nil {
+		return "", errSnapshotNotFound
+	}
+	return snapshot.Namespace, nil
+}
+
+// snapshotData reads the content of the snapshot a volume is staged from.
+func (ns *nodeServer) snapshotData(id string) ([]byte, error) {
+	if ns.config.snapshots == nil {
+		return nil, errSnapshotsNotSupported
+	}
+	data, err := ns.config.snapshots.data(id)
+	if os.IsNotExist(err) {
+		return nil, errSnapshotNotFound
+	}
+	return data, err
+}
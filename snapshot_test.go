@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSnapshots(t *testing.T) {
+	admin := newFakeAdmin(t)
+	defer admin.Close()
+	ns, dir := testNodeServer(t)
+	defer os.RemoveAll(dir)
+	defer ns.stop()
+	registry, err := openFileRegistry(filepath.Join(dir, "volumes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := openSnapshotStore("file://" + filepath.Join(dir, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.config.snapshots = snapshots
+	cs := newControllerServer(registry, snapshots, nil)
+	ctx := context.Background()
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "source",
+		VolumeCapabilities: []*csi.VolumeCapability{volCap},
+		Parameters:         map[string]string{"uri": admin.URL + "/source", "module": "TREE", pvcNamespaceKey: "team-a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "no-namespace",
+		VolumeCapabilities: []*csi.VolumeCapability{volCap},
+		Parameters:         map[string]string{"uri": admin.URL + "/source", "module": "TREE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createSnapshot := func(name, source string) (*csi.Snapshot, error) {
+		resp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           name,
+			SourceVolumeId: source,
+			Secrets:        map[string]string{"username": "user", "password": "secret"},
+		})
+		return resp.GetSnapshot(), err
+	}
+	snapshot, err := createSnapshot("snap-1", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.GetReadyToUse() || snapshot.GetSizeBytes() != int64(len(admin.body)) || snapshot.GetCreationTime() == nil {
+		t.Errorf("unexpected snapshot: %v", snapshot)
+	}
+	if _, err := createSnapshot("snap-1", "source"); err != nil {
+		t.Errorf("repeated snapshot creation failed: %v", err)
+	}
+	if _, err := createSnapshot("snap-1", "other"); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("snapshot of another volume: unexpected error: %v", err)
+	}
+	if _, err := createSnapshot("snap-2", "unknown"); status.Code(err) != codes.NotFound {
+		t.Errorf("snapshot of unknown volume: unexpected error: %v", err)
+	}
+	if _, err := createSnapshot("snap-2", "no-namespace"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("snapshot of volume without namespace: unexpected error: %v", err)
+	}
+	if resp, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: "source"}); err != nil || len(resp.GetEntries()) != 1 {
+		t.Errorf("unexpected list of snapshots: %v, %v", resp, err)
+	}
+
+	snapshotSource := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"}},
+	}
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                "foreign",
+		VolumeCapabilities:  []*csi.VolumeCapability{volCap},
+		Parameters:          map[string]string{pvcNamespaceKey: "team-b"},
+		VolumeContentSource: snapshotSource,
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("volume from snapshot of another namespace: unexpected error: %v", err)
+	}
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "forged",
+		VolumeCapabilities: []*csi.VolumeCapability{volCap},
+		Parameters:         map[string]string{"uri": admin.URL, "snapshot": "snap-1", pvcNamespaceKey: "team-b"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("snapshot parameter: unexpected error: %v", err)
+	}
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                "restored",
+		VolumeCapabilities:  []*csi.VolumeCapability{volCap},
+		Parameters:          map[string]string{"${env}": "production", pvcNamespaceKey: "team-a"},
+		VolumeContentSource: snapshotSource,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volCtx := resp.GetVolume().GetVolumeContext()
+	if volCtx["snapshot"] != "snap-1" || volCtx["frozen"] != "true" || volCtx["module"] != "TREE" || volCtx["${env}"] != "production" {
+		t.Errorf("unexpected volume context: %v", volCtx)
+	}
+
+	requests := admin.count("")
+	stage := filepath.Join(dir, "stage")
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "restored",
+		StagingTargetPath: stage,
+		VolumeCapability:  volCap,
+		VolumeContext:     volCtx,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.count("") != requests {
+		t.Error("volume created from snapshot requested onlineconf-admin")
+	}
+	ui := ns.updaters[stage]
+	if ui == nil || ui.getStatus().Generation != 1 || !ui.getStatus().Frozen {
+		t.Fatalf("volume is not rendered from snapshot: %+v", ui)
+	}
+	if _, ok := ns.scheduler.entries[ui]; ok {
+		t.Error("volume created from snapshot is scheduled for updates")
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(stage, "TREE.cdb")); err != nil || len(content) == 0 {
+		t.Errorf("snapshot content is not published: %v", err)
+	}
+	for podNamespace, code := range map[string]codes.Code{"": codes.InvalidArgument, "team-b": codes.PermissionDenied} {
+		_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          "restored",
+			StagingTargetPath: stage,
+			TargetPath:        filepath.Join(dir, "target"),
+			VolumeCapability:  volCap,
+			VolumeContext:     map[string]string{podNamespaceKey: podNamespace},
+		})
+		if status.Code(err) != code {
+			t.Errorf("publishing to a pod of namespace %q: unexpected error: %v", podNamespace, err)
+		}
+	}
+
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{}); err != nil || len(resp.GetEntries()) != 0 {
+		t.Errorf("snapshot is not deleted: %v, %v", resp, err)
+	}
+	_, err = ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "restored-2",
+		StagingTargetPath: filepath.Join(dir, "stage-2"),
+		VolumeCapability:  volCap,
+		VolumeContext:     volCtx,
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("staging from deleted snapshot: unexpected error: %v", err)
+	}
+}
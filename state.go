@@ -12,12 +12,40 @@ type state struct {
 }
 
 type updaterState struct {
-	DataDir        string
-	URI            string
-	Username       string
-	Password       string
-	UpdateInterval time.Duration
-	Variables      map[string]string
+	DataDir           string
+	WorkDir           string
+	Module            string
+	Path              string
+	Format            string
+	KeepCDB           bool
+	NotifyURL         string
+	AuditHistory      int
+	Frozen            bool
+	URI               string
+	Endpoint          string // alias resolved to URI and connection settings by nodeConfig.withDefaults, URI is empty then
+	Username          string
+	Password          string
+	Token             string
+	TokenFile         string
+	TokenAudience     string
+	CACert            string
+	TLSCert           string
+	TLSKey            string
+	TLSMinVersion     string
+	TLSServerName     string
+	HTTPProxy         string
+	NoProxy           string
+	RequestTimeout    time.Duration
+	ConnectTimeout    time.Duration
+	UpdateInterval    time.Duration
+	Snapshot          string
+	SnapshotNamespace string // namespace of the snapshot, the volume is published to pods of this namespace only
+	SecretNamespace   string // namespace declared by the node-stage secret, checked against the policy of namespaces of pods
+	Variables         map[string]string
+	Chown             bool
+	UID               int
+	GID               int
+	SELinuxContext    string
 }
 
 func readState(path string) (*state, error) {
@@ -44,11 +72,11 @@ func readState(path string) (*state, error) {
 	return s, nil
 }
 
+// save writes the state atomically, the file contains credentials so it is readable by owner only.
 func (s *state) save() error {
-	f, err := os.Create(s.path)
+	content, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(s)
+	return writeFileAtomic(s.path, append(content, '\n'), 0600)
 }
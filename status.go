@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Files with this prefix in the volume root are maintained by the driver itself.
+const metadataPrefix = ".onlineconf-"
+
+const statusFile = metadataPrefix + "status.json"
+
+// volumeStatus is published into the volume root to let applications check freshness of their configuration.
+type volumeStatus struct {
+	URI         string     `json:"uri"`
+	Endpoint    string     `json:"endpoint,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Generation  int        `json:"generation"`
+	Hash        string     `json:"hash,omitempty"`
+	Frozen      bool       `json:"frozen"`
+}
+
+func newVolumeStatus(state updaterState) volumeStatus {
+	return volumeStatus{
+		URI:      stripCredentials(state.URI),
+		Endpoint: state.Endpoint,
+		Frozen:   state.Frozen,
+	}
+}
+
+func (s *volumeStatus) reportAttempt(err error) {
+	now := time.Now().UTC()
+	s.LastAttempt = &now
+	if err == nil {
+		s.LastSuccess = &now
+		s.LastError = ""
+	} else {
+		s.LastError = err.Error()
+	}
+}
+
+func (s *volumeStatus) write(dir string, state updaterState) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, statusFile)
+	if err := writeFileAtomic(path, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return setPathAttributes(path, state)
+}
+
+func stripCredentials(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
+
+// hash returns a digest of file names and contents, equal data always has equal hash.
+func (data volumeData) hash() string {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write(data[name])
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
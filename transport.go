@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// The updater library always uses http.DefaultTransport and gives no way to configure its HTTP client,
+// so the driver replaces http.DefaultTransport with adminRouter.
+// Every updater is given a URI with a random fake host, and the router sends its requests
+// to the real URI of onlineconf-admin through a transport configured for the volume.
+// Transports are shared by all volumes with equal settings.
+// The router also authenticates requests with current credentials of the volume, so they can be rotated without restarting the updater:
+// a bearer token (static, read from a file before every request or a service account token of a pod the volume is published to)
+// or basic authentication.
+// Requests to other hosts are passed to the original transport.
+// The host is the only secret of a route: any HTTP client of the process using http.DefaultTransport
+// would get credentials of a volume added to its requests, so hosts must never be guessable or exposed
+// (notifications use their own transport and notifyURL can't point to adminRouteDomain).
+// Redirects to a route from another host, including another route, are rejected, so onlineconf-admin of one volume
+// can't make the updater send credentials of another one.
+const adminRouteDomain = ".onlineconf-csi.invalid"
+
+// routeURIPattern matches URIs of routes in errors of requests.
+var routeURIPattern = regexp.MustCompile(`http://volume-[0-9a-f]+` + regexp.QuoteMeta(adminRouteDomain))
+
+// hideRoutes replaces routeURI in the error of a request with uri of onlineconf-admin and hides URIs of other routes.
+// Errors of updates are written to the status file visible to pods, to logs and to the admin API, and must not expose route hosts.
+func hideRoutes(err error, routeURI, uri string) error {
+	if err == nil || !routeURIPattern.MatchString(err.Error()) {
+		return err
+	}
+	return errors.New(routeURIPattern.ReplaceAllStringFunc(err.Error(), func(match string) string {
+		if match == routeURI {
+			return uri
+		}
+		return "http://hidden" + adminRouteDomain
+	}))
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// transportSettings are settings of a connection to onlineconf-admin, volumes with equal settings share a transport.
+type transportSettings struct {
+	caCert         string
+	clientCert     string
+	clientKey      string
+	tlsMinVersion  string
+	tlsServerName  string
+	httpProxy      string
+	noProxy        string
+	connectTimeout time.Duration
+}
+
+func (state *updaterState) transportSettings() transportSettings {
+	return transportSettings{
+		caCert:         state.CACert,
+		clientCert:     state.TLSCert,
+		clientKey:      state.TLSKey,
+		tlsMinVersion:  state.TLSMinVersion,
+		tlsServerName:  state.TLSServerName,
+		httpProxy:      state.HTTPProxy,
+		noProxy:        state.NoProxy,
+		connectTimeout: state.ConnectTimeout,
+	}
+}
+
+// tlsConfig returns TLS config for the settings or nil if they are empty.
+func (ts transportSettings) tlsConfig() (*tls.Config, error) {
+	if ts.caCert == "" && ts.clientCert == "" && ts.clientKey == "" && ts.tlsMinVersion == "" && ts.tlsServerName == "" {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: ts.tlsServerName}
+	if ts.tlsMinVersion != "" {
+		version, ok := tlsVersions[ts.tlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %q", ts.tlsMinVersion)
+		}
+		config.MinVersion = version
+	}
+	if ts.caCert != "" {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM([]byte(ts.caCert)) {
+			return nil, errors.New("ca.crt contains no valid PEM encoded certificates")
+		}
+	}
+	if ts.clientCert != "" || ts.clientKey != "" {
+		if ts.clientCert == "" || ts.clientKey == "" {
+			return nil, errors.New("tls.crt and tls.key must be set together")
+		}
+		cert, err := tls.X509KeyPair([]byte(ts.clientCert), []byte(ts.clientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// proxy returns the proxy function for the settings or nil if proxy settings of the environment must be used.
+func (ts transportSettings) proxy() func(*http.Request) (*url.URL, error) {
+	if ts.httpProxy == "" && ts.noProxy == "" {
+		return nil
+	}
+	config := httpproxy.FromEnvironment()
+	if ts.httpProxy != "" {
+		config.HTTPProxy = ts.httpProxy
+		config.HTTPSProxy = ts.httpProxy
+	}
+	if ts.noProxy != "" {
+		config.NoProxy = ts.noProxy
+	}
+	proxyFunc := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+// newTransport returns a clone of base configured with the settings and tlsConfig returned by tlsConfig.
+func (ts transportSettings) newTransport(base *http.Transport, tlsConfig *tls.Config) *http.Transport {
+	t := base.Clone()
+	if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig
+	}
+	if proxy := ts.proxy(); proxy != nil {
+		t.Proxy = proxy
+	}
+	if ts.connectTimeout != 0 {
+		t.DialContext = (&net.Dialer{Timeout: ts.connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		t.TLSHandshakeTimeout = ts.connectTimeout
+	}
+	return t
+}
+
+func newAdminRoute(state updaterState) (*adminRoute, error) {
+	uri, err := url.Parse(state.URI)
+	if err != nil {
+		return nil, err
+	}
+	return &adminRoute{
+		uri:       uri,
+		settings:  state.transportSettings(),
+		username:  state.Username,
+		password:  state.Password,
+		token:     state.Token,
+		tokenFile: state.TokenFile,
+		timeout:   state.RequestTimeout,
+	}, nil
+}
+
+var errNoPodToken = errors.New("no valid service account token, the volume is not published to any pod yet")
+var errServiceAccountMismatch = errors.New("service account of the pod differs from service account of other pods")
+var errCrossRouteRedirect = errors.New("redirect to onlineconf-admin of another volume")
+
+type adminRoute struct {
+	host      string
+	uri       *url.URL
+	settings  transportSettings
+	transport http.RoundTripper
+	username  string
+	password  string
+	token     string
+	tokenFile string
+	podTokens map[string]podToken // by target path, nil if pod tokens are not used
+	timeout   time.Duration       // of a whole request including reading of the response body, 0 if not limited
+	snapshot  []byte              // response served instead of onlineconf-admin for volumes created from snapshots
+}
+
+// podToken is a service account token of a pod the volume is published to.
+type podToken struct {
+	token          string
+	expires        time.Time
+	serviceAccount string // <namespace>/<name>
+}
+
+// podToken returns a valid token of pods the volume is published to with the latest expiration time.
+func (route *adminRoute) podToken() (string, error) {
+	var best podToken
+	for _, t := range route.podTokens {
+		if (t.expires.IsZero() || t.expires.After(time.Now())) && (best.token == "" || t.expires.After(best.expires)) {
+			best = t
+		}
+	}
+	if best.token == "" {
+		return "", errNoPodToken
+	}
+	return best.token, nil
+}
+
+// readTokenFile reads the token file, it is checked every time, because symlinks can be changed after staging.
+func readTokenFile(path string) (string, error) {
+	resolved, err := checkTokenFile(path)
+	if err != nil {
+		return "", err
+	}
+	token, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %w", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+type sharedTransport struct {
+	transport *http.Transport
+	refs      int
+}
+
+type adminRouter struct {
+	base *http.Transport
+
+	m          sync.RWMutex
+	routes     map[string]*adminRoute // by fake host
+	transports map[transportSettings]*sharedTransport
+}
+
+var (
+	defaultAdminRouter     *adminRouter
+	defaultAdminRouterOnce sync.Once
+)
+
+// installAdminRouter replaces http.DefaultTransport with adminRouter
+// tuned to keep enough idle connections for every worker of the scheduler.
+func installAdminRouter(workers int) *adminRouter {
+	defaultAdminRouterOnce.Do(func() {
+		base, ok := http.DefaultTransport.(*http.Transport)
+		if !ok {
+			base = &http.Transport{}
+		}
+		defaultAdminRouter = newAdminRouter(base.Clone())
+		http.DefaultTransport = defaultAdminRouter
+	})
+	defaultAdminRouter.m.Lock()
+	defer defaultAdminRouter.m.Unlock()
+	if base := defaultAdminRouter.base; base.MaxIdleConnsPerHost < workers {
+		base.MaxIdleConnsPerHost = workers
+		if base.MaxIdleConns != 0 && base.MaxIdleConns < workers {
+			base.MaxIdleConns = workers
+		}
+	}
+	return defaultAdminRouter
+}
+
+func newAdminRouter(base *http.Transport) *adminRouter {
+	return &adminRouter{
+		base:       base,
+		routes:     make(map[string]*adminRoute),
+		transports: make(map[transportSettings]*sharedTransport),
+	}
+}
+
+// add registers a route to the onlineconf-admin of the volume and returns the URI the updater must use.
+func (ar *adminRouter) add(state updaterState) (string, error) {
+	route, err := newAdminRoute(state)
+	if err != nil {
+		return "", err
+	}
+	tlsConfig, err := route.settings.tlsConfig()
+	if err != nil {
+		return "", err
+	}
+	if state.TokenAudience != "" {
+		route.podTokens = make(map[string]podToken)
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	host := "volume-" + hex.EncodeToString(secret) + adminRouteDomain
+
+	ar.m.Lock()
+	defer ar.m.Unlock()
+	route.transport = ar.acquireTransport(route.settings, tlsConfig)
+	route.host = host
+	ar.routes[route.host] = route
+	return "http://" + route.host, nil
+}
+
+// update applies changed URI, credentials and connection settings of the volume to its route.
+func (ar *adminRouter) update(routeURI string, state updaterState) error {
+	updated, err := newAdminRoute(state)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := updated.settings.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	ar.m.Lock()
+	defer ar.m.Unlock()
+	route := ar.route(routeURI)
+	if route == nil {
+		return nil
+	}
+	if updated.settings != route.settings {
+		transport := ar.acquireTransport(updated.settings, tlsConfig)
+		ar.releaseTransport(route.settings)
+		route.settings = updated.settings
+		route.transport = transport
+	}
+	if state.TokenAudience == "" {
+		route.podTokens = nil
+	} else if route.podTokens == nil {
+		route.podTokens = make(map[string]podToken)
+	}
+	route.uri = updated.uri
+	route.username = updated.username
+	route.password = updated.password
+	route.token = updated.token
+	route.tokenFile = updated.tokenFile
+	route.timeout = updated.timeout
+	return nil
+}
+
+// remove unregisters the route returned by add.
+func (ar *adminRouter) remove(routeURI string) {
+	ar.m.Lock()
+	defer ar.m.Unlock()
+	route := ar.route(routeURI)
+	if route == nil {
+		return
+	}
+	delete(ar.routes, route.host)
+	ar.releaseTransport(route.settings)
+}
+
+func (ar *adminRouter) acquireTransport(settings transportSettings, tlsConfig *tls.Config) http.RoundTripper {
+	st := ar.transports[settings]
+	if st == nil {
+		st = &sharedTransport{transport: settings.newTransport(ar.base, tlsConfig)}
+		ar.transports[settings] = st
+	}
+	st.refs++
+	return st.transport
+}
+
+func (ar *adminRouter) releaseTransport(settings transportSettings) {
+	if st := ar.transports[settings]; st != nil {
+		if st.refs--; st.refs == 0 {
+			delete(ar.transports, settings)
+			st.transport.CloseIdleConnections()
+		}
+	}
+}
+
+// setPodToken sets the service account token of the pod the volume is published to at target path.
+// All pods of the volume share the same content, so they must have the same service account,
+// otherwise a pod could read configuration available to another service account only.
+func (ar *adminRouter) setPodToken(routeURI, target string, token podToken) error {
+	ar.m.Lock()
+	defer ar.m.Unlock()
+	if route := ar.route(routeURI); route != nil && route.podTokens != nil {
+		for t, other := range route.podTokens {
+			if t != target && other.serviceAccount != token.serviceAccount {
+				return fmt.Errorf("%w: the volume is published to pods of service account %s", errServiceAccountMismatch, other.serviceAccount)
+			}
+		}
+		route.podTokens[target] = token
+	}
+	return nil
+}
+
+// removePodToken removes the service account token of the pod the volume is unpublished from.
+func (ar *adminRouter) removePodToken(routeURI, target string) {
+	ar.m.Lock()
+	defer ar.m.Unlock()
+	if route := ar.route(routeURI); route != nil && route.podTokens != nil {
+		delete(route.podTokens, target)
+	}
+}
+
+// setSnapshot makes the route serve the stored response of onlineconf-admin instead of requesting it.
+func (ar *adminRouter) setSnapshot(routeURI string, data []byte) {
+	ar.m.Lock()
+	defer ar.m.Unlock()
+	if route := ar.route(routeURI); route != nil {
+		route.snapshot = data
+	}
+}
+
+func (ar *adminRouter) route(routeURI string) *adminRoute {
+	u, err := url.Parse(routeURI)
+	if err != nil {
+		return nil
+	}
+	return ar.routes[u.Host]
+}
+
+func (ar *adminRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	ar.m.RLock()
+	route := ar.routes[req.URL.Host]
+	base := ar.base
+	if route == nil {
+		ar.m.RUnlock()
+		return base.RoundTrip(req)
+	}
+	if prev := req.Response; prev != nil && (prev.Request == nil || prev.Request.URL.Host != req.URL.Host) {
+		ar.m.RUnlock()
+		return nil, errCrossRouteRedirect
+	}
+	if snapshot := route.snapshot; snapshot != nil {
+		ar.m.RUnlock()
+		return snapshotResponse(req, snapshot), nil
+	}
+	uri, transport, timeout := *route.uri, route.transport, route.timeout
+	username, password, token, tokenFile := route.username, route.password, route.token, route.tokenFile
+	var tokenErr error
+	if route.podTokens != nil {
+		token, tokenErr = route.podToken()
+	}
+	ar.m.RUnlock()
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	if tokenFile != "" {
+		if token, tokenErr = readTokenFile(tokenFile); tokenErr != nil {
+			return nil, tokenErr
+		}
+	}
+
+	u := uri
+	u.User = nil
+	u.Path = uri.Path + req.URL.Path
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	ctx, cancel := req.Context(), context.CancelFunc(nil)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	orig := req
+	req = req.Clone(ctx)
+	req.URL = &u
+	req.Host = ""
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Request = orig // redirects are checked against the route host, not the real one
+	}
+	if cancel != nil {
+		if err != nil {
+			cancel()
+		} else {
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		}
+	}
+	return resp, err
+}
+
+func snapshotResponse(req *http.Request, data []byte) *http.Response {
+	header := make(http.Header)
+	header.Set("X-OnlineConf-Admin-Last-Modified", "snapshot")
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+}
+
+// cancelBody releases the request timeout when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (ar *adminRouter) CloseIdleConnections() {
+	ar.m.RLock()
+	defer ar.m.RUnlock()
+	ar.base.CloseIdleConnections()
+	for _, st := range ar.transports {
+		st.transport.CloseIdleConnections()
+	}
+}
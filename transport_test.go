@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testClientCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "onlineconf-csi"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestAdminRouter(t *testing.T) {
+	var clientCN, path string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCN, path = "", r.URL.Path
+		if len(r.TLS.PeerCertificates) > 0 {
+			clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	clientCert, clientKey := testClientCert(t)
+
+	ar := newAdminRouter(&http.Transport{})
+	client := &http.Client{Transport: ar}
+	get := func(state updaterState) error {
+		uri, err := ar.add(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ar.remove(uri)
+		resp, err := client.Get(uri + "/client/config")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(updaterState{URI: server.URL}); err == nil {
+		t.Error("untrusted server certificate is accepted")
+	}
+	if err := get(updaterState{URI: server.URL + "/prefix", CACert: caCert, TLSMinVersion: "1.2"}); err != nil {
+		t.Errorf("request failed: %v", err)
+	} else if path != "/prefix/client/config" || clientCN != "" {
+		t.Errorf("unexpected request: path %q, client %q", path, clientCN)
+	}
+	if err := get(updaterState{URI: server.URL, CACert: caCert, TLSServerName: "example.com", TLSCert: clientCert, TLSKey: clientKey}); err != nil {
+		t.Errorf("mTLS request failed: %v", err)
+	} else if clientCN != "onlineconf-csi" {
+		t.Errorf("client certificate is not presented: %q", clientCN)
+	}
+	if err := get(updaterState{URI: server.URL, CACert: caCert, TLSServerName: "onlineconf.invalid"}); err == nil {
+		t.Error("server name is not verified")
+	}
+
+	state := updaterState{URI: server.URL, CACert: caCert}
+	uri1, _ := ar.add(state)
+	uri2, _ := ar.add(state)
+	if uri1 == uri2 || len(ar.transports) != 1 {
+		t.Errorf("transport is not shared: %d transports", len(ar.transports))
+	}
+	if len(uri1) < len("http://volume-"+adminRouteDomain)+32 {
+		t.Errorf("route host is guessable: %s", uri1)
+	}
+	ar.remove(uri1)
+	ar.remove(uri2)
+	if len(ar.transports) != 0 || len(ar.routes) != 0 {
+		t.Errorf("routes are not removed: %d transports, %d routes", len(ar.transports), len(ar.routes))
+	}
+
+	for _, state := range []updaterState{
+		{CACert: "invalid"},
+		{TLSCert: clientCert},
+		{TLSCert: clientCert, TLSKey: caCert},
+		{TLSMinVersion: "1.4"},
+	} {
+		if _, err := state.transportSettings().tlsConfig(); err == nil {
+			t.Errorf("invalid settings are accepted: %+v", state)
+		}
+	}
+}
+
+func TestAdminRouterRedirect(t *testing.T) {
+	var target string
+	var auth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/a/client/config":
+			http.Redirect(w, r, target, http.StatusFound)
+		case "/a/moved":
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+	ar := newAdminRouter(&http.Transport{})
+	client := &http.Client{Transport: ar}
+	uriA, err := ar.add(updaterState{URI: server.URL + "/a", Token: "token-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uriB, err := ar.add(updaterState{URI: server.URL + "/b", Token: "token-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target = "/moved"
+	if resp, err := client.Get(uriA + "/client/config"); err != nil {
+		t.Errorf("redirect within the route failed: %v", err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusOK || len(auth) != 2 || auth[1] != "Bearer token-a" {
+		t.Errorf("unexpected redirect within the route: %d, %v", resp.StatusCode, auth)
+	}
+
+	auth = nil
+	target = uriB + "/client/config"
+	if _, err := client.Get(uriA + "/client/config"); !errors.Is(err, errCrossRouteRedirect) {
+		t.Errorf("redirect to another route: unexpected error: %v", err)
+	}
+	for _, a := range auth {
+		if a == "Bearer token-b" {
+			t.Error("credentials of another route are sent after redirect")
+		}
+	}
+}
+
+func TestAdminRouterToken(t *testing.T) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "onlineconf-csi-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "tokens", "token")
+	if err := os.Mkdir(filepath.Dir(tokenFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	savedTokenFileDir := tokenFileDir
+	defer func() { tokenFileDir = savedTokenFileDir }()
+	tokenFileDir = filepath.Dir(tokenFile)
+
+	ar := newAdminRouter(&http.Transport{})
+	get := func(uri string) error {
+		req, _ := http.NewRequest("GET", uri+"/client/config", nil)
+		req.SetBasicAuth("user", "password")
+		resp, err := (&http.Client{Transport: ar}).Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	uri, _ := ar.add(updaterState{URI: server.URL, Token: "secret"})
+	if err := get(uri); err != nil || auth != "Bearer secret" {
+		t.Errorf("token is not sent: %q, %v", auth, err)
+	}
+	uri, _ = ar.add(updaterState{URI: server.URL})
+	if err := get(uri); err != nil || !strings.HasPrefix(auth, "Basic ") {
+		t.Errorf("basic authentication is replaced: %q, %v", auth, err)
+	}
+
+	uri, _ = ar.add(updaterState{URI: server.URL, TokenFile: tokenFile})
+	if err := get(uri); err == nil {
+		t.Error("missing token file is ignored")
+	}
+	for _, token := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(uri); err != nil || auth != "Bearer "+token {
+			t.Errorf("token file is not re-read: %q, %v", auth, err)
+		}
+	}
+
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte("node secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(uri); err == nil || auth == "Bearer node secret" {
+		t.Errorf("token file is read through a symlink outside of the token directory: %q, %v", auth, err)
+	}
+	for _, file := range []string{secret, filepath.Join(tokenFileDir, "..", "secret"), "/etc/shadow"} {
+		uri, _ = ar.add(updaterState{URI: server.URL, TokenFile: file})
+		if err := get(uri); err == nil {
+			t.Errorf("token file outside of the token directory is read: %s", file)
+		}
+		if _, err := checkTokenFile(file); err == nil {
+			t.Errorf("token file outside of the token directory is allowed: %s", file)
+		}
+	}
+	tokenFileDir = ""
+	if _, err := checkTokenFile(tokenFile); err == nil {
+		t.Error("token file is allowed without token directory")
+	}
+	tokenFileDir = filepath.Dir(tokenFile)
+
+	uri, _ = ar.add(updaterState{URI: server.URL, TokenAudience: "onlineconf"})
+	if err := get(uri); err == nil {
+		t.Error("request without pod token succeeded")
+	}
+	now := time.Now()
+	for target, token := range map[string]podToken{
+		"/pod1": {token: "pod1", expires: now.Add(time.Hour), serviceAccount: "default/app"},
+		"/pod2": {token: "pod2", expires: now.Add(2 * time.Hour), serviceAccount: "default/app"},
+		"/pod3": {token: "pod3", expires: now.Add(-time.Hour), serviceAccount: "default/app"},
+	} {
+		if err := ar.setPodToken(uri, target, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := podToken{token: "other", expires: now.Add(3 * time.Hour), serviceAccount: "default/other"}
+	if err := ar.setPodToken(uri, "/pod4", other); !errors.Is(err, errServiceAccountMismatch) {
+		t.Errorf("token of another service account: unexpected error: %v", err)
+	}
+	if err := get(uri); err != nil || auth != "Bearer pod2" {
+		t.Errorf("unexpected pod token: %q, %v", auth, err)
+	}
+	ar.removePodToken(uri, "/pod2")
+	if err := get(uri); err != nil || auth != "Bearer pod1" {
+		t.Errorf("unexpected pod token: %q, %v", auth, err)
+	}
+	ar.removePodToken(uri, "/pod1")
+	if err := get(uri); err == nil {
+		t.Error("expired pod token is used")
+	}
+}
+
+func TestAdminRouterProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	ar := newAdminRouter(&http.Transport{})
+	get := func(uri string) error {
+		resp, err := (&http.Client{Transport: ar}).Get(uri + "/client/config")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	uri, _ := ar.add(updaterState{URI: "http://onlineconf.invalid/prefix", HTTPProxy: proxy.URL})
+	if err := get(uri); err != nil || len(proxied) != 1 || proxied[0] != "http://onlineconf.invalid/prefix/client/config" {
+		t.Errorf("request is not sent through proxy: %v, %v", proxied, err)
+	}
+	uri, _ = ar.add(updaterState{URI: "http://onlineconf.invalid", HTTPProxy: proxy.URL, NoProxy: ".invalid"})
+	if err := get(uri); err == nil || len(proxied) != 1 {
+		t.Errorf("request to excluded host is sent through proxy: %v, %v", proxied, err)
+	}
+
+	uri, _ = ar.add(updaterState{URI: slow.URL, RequestTimeout: 50 * time.Millisecond, ConnectTimeout: time.Second})
+	start := time.Now()
+	if err := get(uri); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("request timeout is not applied: %v", err)
+	}
+}